@@ -31,6 +31,7 @@ mkdir -p uploads/csv
 mkdir -p uploads/archive-compare
 mkdir -p static
 mkdir -p templates
+mkdir -p config
 mkdir -p temp
 
 echo "4. Setting executable permissions..."
@@ -34,6 +34,8 @@ func main() {
 	{
 		fileCompare.POST("/upload", tools.HandleFileCompareUpload)
 		fileCompare.GET("/compare", tools.HandleFileCompare)
+		fileCompare.GET("/lines", tools.HandleFileCompareLines)
+		fileCompare.GET("/patch", tools.HandleFileComparePatch)
 	}
 
 	// Tool 2: CSV viewer.
@@ -41,6 +43,8 @@ func main() {
 	{
 		csvViewer.POST("/upload", tools.HandleCSVUpload)
 		csvViewer.GET("/view", tools.HandleCSVView)
+		csvViewer.GET("/index", tools.HandleCSVIndexStatus)
+		csvViewer.GET("/stats", tools.HandleCSVStats)
 	}
 
 	// Tool 3: Archive extraction and trade comparison.
@@ -48,6 +52,48 @@ func main() {
 	{
 		archiveCompare.POST("/upload", tools.HandleArchiveUpload)
 		archiveCompare.GET("/compare", tools.HandleArchiveCompare)
+		archiveCompare.GET("/comparison", tools.HandleArchiveComparison)
+		archiveCompare.GET("/lines", tools.HandleArchiveCompareLines)
+		archiveCompare.GET("/patch", tools.HandleArchiveComparePatch)
+		archiveCompare.GET("/cross-directory", tools.HandleCrossDirectoryCompare)
+		archiveCompare.GET("/cross-directory/diff", tools.HandleCrossDirectoryDiff)
+		archiveCompare.POST("/jobs", tools.HandleArchiveJobSubmit)
+		archiveCompare.GET("/jobs/:id", tools.HandleArchiveJobStatus)
+		archiveCompare.GET("/jobs/:id/result", tools.HandleArchiveJobResult)
+		archiveCompare.GET("/jobs/:id/events", tools.HandleArchiveJobEvents)
+		archiveCompare.GET("/jobs/:id/patch", tools.HandleArchiveJobPatch)
+		archiveCompare.POST("/jobs/:id/cancel", tools.HandleArchiveJobCancel)
+		archiveCompare.POST("/releases/upload", tools.HandleReleaseUpload)
+		archiveCompare.GET("/releases/compare", tools.HandleReleaseCompare)
+	}
+
+	// Tool 4: Keyed CSV comparison.
+	csvCompare := r.Group("/api/csv-compare")
+	{
+		csvCompare.POST("/upload", tools.HandleCSVCompareUpload)
+		csvCompare.GET("/compare", tools.HandleCSVCompare)
+	}
+
+	// Shared comparison settings.
+	ignoreRules := r.Group("/api/ignore-rules")
+	{
+		ignoreRules.GET("", tools.HandleIgnoreRulesList)
+		ignoreRules.POST("", tools.HandleIgnoreRulesSave)
+		ignoreRules.DELETE("/:name", tools.HandleIgnoreRulesDelete)
+	}
+
+	pairingRules := r.Group("/api/pairing-rules")
+	{
+		pairingRules.GET("", tools.HandlePairingRulesList)
+		pairingRules.POST("", tools.HandlePairingRulesSave)
+		pairingRules.DELETE("/:name", tools.HandlePairingRulesDelete)
+	}
+
+	riskFormats := r.Group("/api/risk-formats")
+	{
+		riskFormats.GET("", tools.HandleRiskFormatsList)
+		riskFormats.POST("", tools.HandleRiskFormatsSave)
+		riskFormats.DELETE("/:name", tools.HandleRiskFormatsDelete)
 	}
 
 	// Create required directories.
@@ -66,6 +112,7 @@ func createDirectories() {
 		"uploads/archive-compare",
 		"static",
 		"templates",
+		"config",
 		"temp",
 	}
 
@@ -0,0 +1,361 @@
+package tools
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Supported archive formats.
+const (
+	archiveFormatZip      = "zip"
+	archiveFormatTar      = "tar"
+	archiveFormatTarGzip  = "tar.gz"
+	archiveFormatTarBzip2 = "tar.bz2"
+	archiveFormatGzip     = "gz"
+	archiveFormatBzip2    = "bz2"
+)
+
+// errUnsupportedArchive is returned for files that are not a known archive.
+var errUnsupportedArchive = errors.New("unsupported archive format; upload a zip, tar, tar.gz, tar.bz2 or gz file")
+
+// tarMagicOffset is the position of the "ustar" magic in a tar header block.
+const tarMagicOffset = 257
+
+// detectArchiveFormat identifies an archive by its magic bytes, looking
+// inside gzip and bzip2 streams for a tar header.
+func detectArchiveFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return archiveFormatZip, nil
+	case isTarHeader(header):
+		return archiveFormatTar, nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		if peekTar(gz) {
+			return archiveFormatTarGzip, nil
+		}
+		return archiveFormatGzip, nil
+	case bytes.HasPrefix(header, []byte("BZh")):
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		if peekTar(bzip2.NewReader(file)) {
+			return archiveFormatTarBzip2, nil
+		}
+		return archiveFormatBzip2, nil
+	}
+
+	return "", errUnsupportedArchive
+}
+
+// isTarHeader reports whether the block carries the POSIX or GNU tar magic.
+func isTarHeader(block []byte) bool {
+	return len(block) >= tarMagicOffset+5 && string(block[tarMagicOffset:tarMagicOffset+5]) == "ustar"
+}
+
+// peekTar reports whether a decompressed stream starts with a tar header.
+func peekTar(r io.Reader) bool {
+	block := make([]byte, 512)
+	n, _ := io.ReadFull(r, block)
+	return isTarHeader(block[:n])
+}
+
+// extractLimits bounds what an archive may write to disk when extracted.
+type extractLimits struct {
+	MaxEntries   int     // Maximum number of files and directories.
+	MaxEntrySize int64   // Maximum uncompressed size of a single file.
+	MaxTotalSize int64   // Maximum uncompressed size of all files.
+	MaxRatio     float64 // Maximum uncompressed to compressed size ratio.
+}
+
+var defaultExtractLimits = extractLimits{
+	MaxEntries:   20000,
+	MaxEntrySize: 512 << 20,
+	MaxTotalSize: 2 << 30,
+	MaxRatio:     200,
+}
+
+// ratioCheckThreshold is the uncompressed size below which compression
+// ratios are not checked, so small highly compressible files are accepted.
+const ratioCheckThreshold = 1 << 20
+
+// archiveRejection reports an archive refused because it is unsafe to extract.
+// Entry is empty when the archive as a whole is rejected.
+type archiveRejection struct {
+	Entry  string
+	Reason string
+}
+
+func (e *archiveRejection) Error() string {
+	if e.Entry == "" {
+		return "archive rejected: " + e.Reason
+	}
+	return fmt.Sprintf("archive entry %q rejected: %s", e.Entry, e.Reason)
+}
+
+// isArchiveClientError reports whether an extraction error is caused by the
+// uploaded archive rather than by the server.
+func isArchiveClientError(err error) bool {
+	var rejection *archiveRejection
+	return errors.Is(err, errUnsupportedArchive) || errors.As(err, &rejection)
+}
+
+// extractor writes archive entries below dest while enforcing the limits.
+type extractor struct {
+	dest        string
+	limits      extractLimits
+	archiveSize int64
+	entries     int
+	total       int64
+}
+
+// extractArchive extracts any supported archive into dest. A partially
+// extracted directory is removed when extraction fails.
+func extractArchive(src, dest string) error {
+	err := extractArchiveWithLimits(src, dest, defaultExtractLimits)
+	if err != nil {
+		os.RemoveAll(dest)
+	}
+	return err
+}
+
+func extractArchiveWithLimits(src, dest string, limits extractLimits) error {
+	format, err := detectArchiveFormat(src)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	x := &extractor{dest: dest, limits: limits, archiveSize: info.Size()}
+
+	switch format {
+	case archiveFormatZip:
+		return x.extractZip(file, info.Size())
+	case archiveFormatTar:
+		return x.extractTar(file)
+	case archiveFormatTarGzip, archiveFormatGzip:
+		gz, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		if format == archiveFormatTarGzip {
+			return x.extractTar(gz)
+		}
+		name := gz.Name
+		if name == "" {
+			name = strings.TrimSuffix(filepath.Base(src), ".gz")
+		}
+		return x.extractFile(filepath.Base(name), gz, -1, 0644)
+	case archiveFormatTarBzip2:
+		return x.extractTar(bzip2.NewReader(bufio.NewReader(file)))
+	case archiveFormatBzip2:
+		return x.extractFile(strings.TrimSuffix(filepath.Base(src), ".bz2"), bzip2.NewReader(bufio.NewReader(file)), -1, 0644)
+	}
+
+	return errUnsupportedArchive
+}
+
+func (x *extractor) extractZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	if len(zr.File) > x.limits.MaxEntries {
+		return &archiveRejection{Reason: fmt.Sprintf("archive has %d entries, limit is %d", len(zr.File), x.limits.MaxEntries)}
+	}
+
+	// Iterate through archive entries.
+	for _, f := range zr.File {
+		mode := f.FileInfo().Mode()
+
+		switch {
+		case mode&os.ModeSymlink != 0:
+			return &archiveRejection{Entry: f.Name, Reason: "symbolic links are not allowed"}
+		case mode.IsDir():
+			if err := x.extractDir(f.Name); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			// Check the declared sizes up front; the copy enforces the real ones.
+			if f.UncompressedSize64 > ratioCheckThreshold && f.CompressedSize64 > 0 &&
+				float64(f.UncompressedSize64)/float64(f.CompressedSize64) > x.limits.MaxRatio {
+				return &archiveRejection{Entry: f.Name, Reason: fmt.Sprintf("compression ratio exceeds %.0f:1", x.limits.MaxRatio)}
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = x.extractFile(f.Name, rc, int64(f.UncompressedSize64), mode)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return &archiveRejection{Entry: f.Name, Reason: "unsupported entry type " + mode.Type().String()}
+		}
+	}
+
+	return nil
+}
+
+func (x *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+
+	// Iterate through archive entries.
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeXGlobalHeader:
+			// Archive-wide metadata, e.g. the commit ID written by git archive.
+			continue
+		case tar.TypeDir:
+			if err := x.extractDir(header.Name); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := x.extractFile(header.Name, tr, header.Size, header.FileInfo().Mode()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			return &archiveRejection{Entry: header.Name, Reason: "links are not allowed"}
+		default:
+			return &archiveRejection{Entry: header.Name, Reason: fmt.Sprintf("unsupported entry type %q", header.Typeflag)}
+		}
+	}
+}
+
+// entryPath counts an entry against the entry limit and resolves its
+// destination, rejecting absolute paths and paths that leave dest.
+func (x *extractor) entryPath(name string) (string, error) {
+	x.entries++
+	if x.entries > x.limits.MaxEntries {
+		return "", &archiveRejection{Entry: name, Reason: fmt.Sprintf("archive has more than %d entries", x.limits.MaxEntries)}
+	}
+
+	normalized := strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(normalized, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", &archiveRejection{Entry: name, Reason: "absolute paths are not allowed"}
+	}
+	for _, part := range strings.Split(normalized, "/") {
+		if part == ".." {
+			return "", &archiveRejection{Entry: name, Reason: "path escapes the extraction directory"}
+		}
+	}
+
+	path := filepath.Join(x.dest, filepath.FromSlash(normalized))
+	rel, err := filepath.Rel(x.dest, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &archiveRejection{Entry: name, Reason: "path escapes the extraction directory"}
+	}
+	return path, nil
+}
+
+func (x *extractor) extractDir(name string) error {
+	path, err := x.entryPath(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0755)
+}
+
+// extractFile writes one file entry. declaredSize is the size recorded in
+// the archive, or -1 for streams that carry none.
+func (x *extractor) extractFile(name string, r io.Reader, declaredSize int64, mode os.FileMode) error {
+	path, err := x.entryPath(name)
+	if err != nil {
+		return err
+	}
+
+	if declaredSize > x.limits.MaxEntrySize {
+		return &archiveRejection{Entry: name, Reason: fmt.Sprintf("uncompressed size exceeds %d bytes", x.limits.MaxEntrySize)}
+	}
+	if declaredSize > 0 && x.total+declaredSize > x.limits.MaxTotalSize {
+		return &archiveRejection{Entry: name, Reason: fmt.Sprintf("total uncompressed size exceeds %d bytes", x.limits.MaxTotalSize)}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+
+	// Never trust the declared size: copy at most one byte past the limit.
+	limit := x.limits.MaxEntrySize
+	if remaining := x.limits.MaxTotalSize - x.total; remaining < limit {
+		limit = remaining
+	}
+	written, err := io.Copy(outFile, io.LimitReader(r, limit+1))
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+
+	x.total += written
+	if written > x.limits.MaxEntrySize {
+		return &archiveRejection{Entry: name, Reason: fmt.Sprintf("uncompressed size exceeds %d bytes", x.limits.MaxEntrySize)}
+	}
+	if x.total > x.limits.MaxTotalSize {
+		return &archiveRejection{Entry: name, Reason: fmt.Sprintf("total uncompressed size exceeds %d bytes", x.limits.MaxTotalSize)}
+	}
+	if x.total > ratioCheckThreshold && x.archiveSize > 0 && float64(x.total)/float64(x.archiveSize) > x.limits.MaxRatio {
+		return &archiveRejection{Entry: name, Reason: fmt.Sprintf("compression ratio exceeds %.0f:1", x.limits.MaxRatio)}
+	}
+	return nil
+}
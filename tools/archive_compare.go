@@ -1,19 +1,27 @@
 package tools
 
 import (
-	"archive/zip"
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+const (
+	archiveCompareMaxWorkers     = 64
+	archiveCompareDefaultTimeout = 2 * time.Minute
 )
 
 type ArchiveCompareResult struct {
@@ -21,6 +29,8 @@ type ArchiveCompareResult struct {
 	Directories  []string                `json:"directories"`
 	Transactions []TransactionInfo       `json:"transactions"`
 	Comparisons  []TransactionComparison `json:"comparisons"`
+	Issues       []TransactionIssue      `json:"issues"`
+	Summary      ArchiveSummary          `json:"summary"`
 }
 
 type TransactionInfo struct {
@@ -32,19 +42,137 @@ type TransactionInfo struct {
 type TransactionFile struct {
 	Directory string `json:"directory"`
 	FileName  string `json:"file_name"`
-	FilePath  string `json:"file_path"`
-	Type      string `json:"type"` // "baby" or "candy"
+	FilePath  string `json:"-"`    // Server path; never exposed to clients.
+	Type      string `json:"type"` // Side label of the pairing rule, e.g. "baby" or "candy".
 }
 
+// TransactionComparison is the comparison of one trade in one directory. The
+// content, diff and measure fields are detail fields, only included in
+// responses when selected with the fields parameter.
 type TransactionComparison struct {
-	TransactionID string     `json:"transaction_id"`
-	Directory     string     `json:"directory"`
-	BabyFile      string     `json:"baby_file"`
-	CandyFile     string     `json:"candy_file"`
-	BabyContent   string     `json:"baby_content"`
-	CandyContent  string     `json:"candy_content"`
-	DiffHTML      string     `json:"diff_html"`
-	DiffLines     []DiffLine `json:"diff_lines"`
+	TransactionID string          `json:"transaction_id"`
+	Directory     string          `json:"directory"`
+	LeftLabel     string          `json:"left_label"`
+	RightLabel    string          `json:"right_label"`
+	BabyFile      string          `json:"baby_file"`
+	CandyFile     string          `json:"candy_file"`
+	Status        string          `json:"status"` // "identical" or "different"
+	ChangedLines  int             `json:"changed_lines"`
+	Numeric       *NumericSummary `json:"numeric_summary,omitempty"`
+	BabyContent   string          `json:"baby_content,omitempty"`
+	CandyContent  string          `json:"candy_content,omitempty"`
+	DiffHTML      string          `json:"diff_html,omitempty"`
+	DiffLines     []DiffLine      `json:"diff_lines,omitempty"`
+	Hunks         []DiffHunk      `json:"hunks,omitempty"`    // Built from DiffLines with the context parameter.
+	Measures      []RiskMeasure   `json:"measures,omitempty"` // Set when a risk format is selected.
+}
+
+// Comparison statuses.
+const (
+	comparisonIdentical = "identical"
+	comparisonDifferent = "different"
+)
+
+// comparisonFields are the detail fields of a TransactionComparison that can
+// be selected with the fields parameter.
+var comparisonFields = []string{"baby_content", "candy_content", "diff_html", "diff_lines", "hunks", "measures"}
+
+// comparisonSelection picks the detail fields of the comparisons in a
+// response. Fields that are not selected are neither computed nor kept.
+type comparisonSelection struct {
+	fields       map[string]bool
+	contextLines int // Context lines of hunks.
+}
+
+// parseComparisonSelection reads the comma-separated fields parameter, or
+// defaultFields when it is absent, and the context of hunks. "all" selects
+// every field; an empty value selects none.
+func parseComparisonSelection(c *gin.Context, defaultFields string) (comparisonSelection, error) {
+	selection := comparisonSelection{fields: make(map[string]bool)}
+	for _, name := range strings.Split(c.DefaultQuery("fields", defaultFields), ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case name == "all":
+			for _, field := range comparisonFields {
+				selection.fields[field] = true
+			}
+		case slices.Contains(comparisonFields, name):
+			selection.fields[name] = true
+		default:
+			return selection, fmt.Errorf("unknown field %q, expected all or %s", name, strings.Join(comparisonFields, ", "))
+		}
+	}
+
+	var err error
+	selection.contextLines, _, err = parseDiffContext(c)
+	return selection, err
+}
+
+// newComparisonSelection selects the given fields.
+func newComparisonSelection(contextLines int, fields ...string) comparisonSelection {
+	selection := comparisonSelection{fields: make(map[string]bool, len(fields)), contextLines: contextLines}
+	for _, field := range fields {
+		selection.fields[field] = true
+	}
+	return selection
+}
+
+// selectFields returns a copy of the comparison without the detail fields
+// that are not selected, building hunks from the diff lines when needed.
+func (t TransactionComparison) selectFields(selection comparisonSelection) TransactionComparison {
+	fields := selection.fields
+	if fields["hunks"] && t.Hunks == nil && t.DiffLines != nil {
+		t.Hunks = buildDiffHunks(t.DiffLines, selection.contextLines)
+	}
+	if !fields["hunks"] {
+		t.Hunks = nil
+	}
+	if !fields["baby_content"] {
+		t.BabyContent = ""
+	}
+	if !fields["candy_content"] {
+		t.CandyContent = ""
+	}
+	if !fields["diff_html"] {
+		t.DiffHTML = ""
+	}
+	if !fields["diff_lines"] {
+		t.DiffLines = nil
+	}
+	if !fields["measures"] {
+		t.Measures = nil
+	}
+	return t
+}
+
+// selectFields returns a copy of the result whose comparisons only carry the
+// selected detail fields.
+func (r ArchiveCompareResult) selectFields(selection comparisonSelection) ArchiveCompareResult {
+	comparisons := make([]TransactionComparison, len(r.Comparisons))
+	for i, comparison := range r.Comparisons {
+		comparisons[i] = comparison.selectFields(selection)
+	}
+	r.Comparisons = comparisons
+	return r
+}
+
+// Reasons a trade file is reported instead of compared.
+const (
+	issueMissingCounterpart = "missing_counterpart"
+	issueDuplicateFile      = "duplicate_file"
+	issueUnreadableFile     = "unreadable_file"
+	issueComparisonTimeout  = "comparison_timeout"
+)
+
+// TransactionIssue is a trade file that could not be compared.
+type TransactionIssue struct {
+	TransactionID string `json:"transaction_id"`
+	Directory     string `json:"directory"`
+	Type          string `json:"type"`           // "missing_counterpart", "duplicate_file", "unreadable_file" or "comparison_timeout"
+	Side          string `json:"side,omitempty"` // Side label of the file; empty for timeouts.
+	File          string `json:"file,omitempty"`
+	Reason        string `json:"reason"`
 }
 
 func HandleArchiveUpload(c *gin.Context) {
@@ -62,10 +190,9 @@ func HandleArchiveUpload(c *gin.Context) {
 		return
 	}
 
-	// Validate file extension.
-	ext := filepath.Ext(file.Filename)
-	if ext != ".zip" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "please upload a ZIP archive"})
+	rule, err := lookupPairingRule(c.PostForm("pairing_rule"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -81,100 +208,259 @@ func HandleArchiveUpload(c *gin.Context) {
 
 	// Extract archive.
 	extractDir := filepath.Join(uploadDir, fmt.Sprintf("extracted_%d", timestamp))
-	if err := extractZip(filePath, extractDir); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to extract archive: " + err.Error()})
+	if err := extractArchive(filePath, extractDir); err != nil {
+		status := http.StatusInternalServerError
+		if isArchiveClientError(err) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": "failed to extract archive: " + err.Error()})
 		return
 	}
 
 	// Analyze extracted structure.
-	directories, transactions, err := analyzeExtractedArchive(extractDir)
+	directories, transactions, err := analyzeExtractedArchive(extractDir, rule)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to analyze archive structure: " + err.Error()})
 		return
 	}
 
+	id, err := uploads.Register(uploadKindArchive, extractDir, file.Filename)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register upload"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message":      "archive uploaded and extracted successfully",
-		"archive_file": filePath,
-		"extract_dir":  extractDir,
+		"extract_dir":  id,
 		"directories":  directories,
 		"transactions": transactions,
 	})
 }
 
 func HandleArchiveCompare(c *gin.Context) {
-	extractDir := c.Query("extract_dir")
+	req, ok := parseArchiveCompareRequest(c)
+	if !ok {
+		return
+	}
 
-	if extractDir == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing extract directory parameter"})
+	var err error
+	if req.selection, err = parseComparisonSelection(c, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Analyze extracted structure.
-	directories, transactions, err := analyzeExtractedArchive(extractDir)
+	result, err := runArchiveCompare(c.Request.Context(), req, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to analyze archive structure: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Compare trade files.
-	comparisons, err := compareTransactionFiles(extractDir, transactions)
+	c.JSON(http.StatusOK, result)
+}
+
+// HandleArchiveComparison returns the detail of one trade in one directory,
+// compared with the same parameters as HandleArchiveCompare. All detail
+// fields are included unless fields selects some.
+func HandleArchiveComparison(c *gin.Context) {
+	req, ok := parseArchiveCompareRequest(c)
+	if !ok {
+		return
+	}
+
+	var err error
+	if req.selection, err = parseComparisonSelection(c, "all"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	comparison, ok := lookupArchiveComparison(c, req)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, comparison)
+}
+
+// HandleArchiveCompareLines returns a window of the line-by-line diff of one
+// trade, used to expand the unchanged runs collapsed between hunks.
+func HandleArchiveCompareLines(c *gin.Context) {
+	req, ok := parseArchiveCompareRequest(c)
+	if !ok {
+		return
+	}
+
+	offset, count, err := parseDiffLinesRange(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to compare trade files: " + err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	result := ArchiveCompareResult{
-		ArchiveName:  filepath.Base(extractDir),
-		Directories:  directories,
-		Transactions: transactions,
-		Comparisons:  comparisons,
+	req.selection = newComparisonSelection(0, "diff_lines")
+	comparison, ok := lookupArchiveComparison(c, req)
+	if !ok {
+		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{
+		"offset": offset,
+		"total":  len(comparison.DiffLines),
+		"lines":  sliceDiffLines(comparison.DiffLines, offset, count),
+	})
 }
 
-func extractZip(src, dest string) error {
-	r, err := zip.OpenReader(src)
+// lookupArchiveComparison compares the trade named by the transaction_id and
+// directory parameters. On failure it writes the error response and returns
+// false.
+func lookupArchiveComparison(c *gin.Context, req archiveCompareRequest) (*TransactionComparison, bool) {
+	transactionID, dir := c.Query("transaction_id"), c.Query("directory")
+	if transactionID == "" || dir == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing transaction_id or directory parameter"})
+		return nil, false
+	}
+
+	_, transactions, err := analyzeExtractedArchive(req.archive.Path, req.rule)
 	if err != nil {
-		return err
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to analyze archive structure: " + err.Error()})
+		return nil, false
 	}
-	defer r.Close()
 
-	os.MkdirAll(dest, 0755)
+	index := slices.IndexFunc(transactions, func(t TransactionInfo) bool { return t.ID == transactionID })
+	if index < 0 || !slices.Contains(transactions[index].Directories, dir) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "trade not found in directory"})
+		return nil, false
+	}
 
-	// Iterate through archive entries.
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), req.timeout)
+	defer cancel()
+	outcome, err := compareTransactionDir(ctx, transactions[index], dir, req)
+	if err != nil {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": fmt.Sprintf("comparing the trade took longer than %s", req.timeout)})
+		return nil, false
+	}
+	if outcome.comparison == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "trade could not be compared", "issues": outcome.issues})
+		return nil, false
+	}
+	return outcome.comparison, true
+}
 
-		path := filepath.Join(dest, f.Name)
+// archiveCompareRequest holds the validated parameters of an archive
+// comparison.
+type archiveCompareRequest struct {
+	archive uploadEntry
+	rule    PairingRule
+	format  *RiskFormat
+	opts    CompareOptions
+	top     int
+	workers int           // Trades compared concurrently.
+	timeout time.Duration // Limit for comparing one trade in one directory.
+
+	selection comparisonSelection // Detail fields computed for each comparison.
+}
 
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(path, f.FileInfo().Mode())
-		} else {
-			os.MkdirAll(filepath.Dir(path), 0755)
-			outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.FileInfo().Mode())
-			if err != nil {
-				rc.Close()
-				return err
-			}
+// parseArchiveCompareRequest validates the comparison parameters. On failure
+// it writes the error response and returns false.
+func parseArchiveCompareRequest(c *gin.Context) (archiveCompareRequest, bool) {
+	var req archiveCompareRequest
+	extractID := c.Query("extract_dir")
 
-			_, err = io.Copy(outFile, rc)
-			outFile.Close()
-			rc.Close()
-			if err != nil {
-				return err
-			}
+	if extractID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing extract directory parameter"})
+		return req, false
+	}
+
+	archive, ok := uploads.Resolve(extractID, uploadKindArchive)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "archive not found"})
+		return req, false
+	}
+	req.archive = archive
+
+	var err error
+	if req.opts, err = parseCompareOptions(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+
+	if req.rule, err = lookupPairingRule(c.Query("pairing_rule")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+
+	// The query selects the risk format, falling back to the pairing rule's.
+	formatName := c.Query("risk_format")
+	if formatName == "" {
+		formatName = req.rule.RiskFormat
+	}
+	if req.format, err = lookupRiskFormat(formatName); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+
+	req.top = archiveSummaryDefaultTop
+	if raw := c.Query("top"); raw != "" {
+		if req.top, err = strconv.Atoi(raw); err != nil || req.top < 0 || req.top > archiveSummaryMaxTop {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid top %q, expected 0 to %d", raw, archiveSummaryMaxTop)})
+			return req, false
 		}
 	}
 
-	return nil
+	req.workers = runtime.NumCPU()
+	if raw := c.Query("workers"); raw != "" {
+		if req.workers, err = strconv.Atoi(raw); err != nil || req.workers < 1 || req.workers > archiveCompareMaxWorkers {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid workers %q, expected 1 to %d", raw, archiveCompareMaxWorkers)})
+			return req, false
+		}
+	}
+
+	if req.timeout, err = parseCompareTimeout(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+
+	return req, true
+}
+
+// parseCompareTimeout reads the per-trade timeout parameter.
+func parseCompareTimeout(c *gin.Context) (time.Duration, error) {
+	raw := c.Query("timeout")
+	if raw == "" {
+		return archiveCompareDefaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(raw)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q, expected a positive duration such as 30s", raw)
+	}
+	return timeout, nil
+}
+
+// runArchiveCompare analyses the extracted archive and compares its trades.
+// progress, when set, reports the number of trades compared.
+func runArchiveCompare(ctx context.Context, req archiveCompareRequest, progress func(done, total int)) (ArchiveCompareResult, error) {
+	// Analyze extracted structure.
+	directories, transactions, err := analyzeExtractedArchive(req.archive.Path, req.rule)
+	if err != nil {
+		return ArchiveCompareResult{}, fmt.Errorf("failed to analyze archive structure: %w", err)
+	}
+
+	// Compare trade files.
+	comparisons, issues, err := compareTransactionFiles(ctx, transactions, req, progress)
+	if err != nil {
+		return ArchiveCompareResult{}, fmt.Errorf("failed to compare trade files: %w", err)
+	}
+
+	return ArchiveCompareResult{
+		ArchiveName:  req.archive.Name,
+		Directories:  directories,
+		Transactions: transactions,
+		Comparisons:  comparisons,
+		Issues:       issues,
+		Summary:      summarizeArchive(comparisons, issues, req.top),
+	}, nil
 }
 
-func analyzeExtractedArchive(extractDir string) ([]string, []TransactionInfo, error) {
+func analyzeExtractedArchive(extractDir string, rule PairingRule) ([]string, []TransactionInfo, error) {
 	var directories []string
 	transactionMap := make(map[string]*TransactionInfo)
 
@@ -200,8 +486,8 @@ func analyzeExtractedArchive(extractDir string) ([]string, []TransactionInfo, er
 
 		// Process potential trade files.
 		fileName := info.Name()
-		if isTransactionFile(fileName) {
-			transactionID, fileType := parseTransactionFileName(fileName)
+		if isTransactionFile(fileName, rule) {
+			transactionID, fileType := parseTransactionFileName(fileName, rule)
 			if transactionID != "" {
 				relPath, _ := filepath.Rel(extractDir, path)
 				dir := filepath.Dir(relPath)
@@ -260,88 +546,250 @@ func analyzeExtractedArchive(extractDir string) ([]string, []TransactionInfo, er
 	return directories, transactions, nil
 }
 
-func isTransactionFile(fileName string) bool {
-	// Validate trade file names: babyy-risk-{id}.txt or candyy-risk-{id}.txt
-	pattern := `^(babyy-risk-|candyy-risk-).*\.txt$`
-	matched, _ := regexp.MatchString(pattern, fileName)
-	return matched
+func isTransactionFile(fileName string, rule PairingRule) bool {
+	// Validate trade file names against either side of the pairing rule.
+	return rule.left.MatchString(fileName) || rule.right.MatchString(fileName)
+}
+
+func parseTransactionFileName(fileName string, rule PairingRule) (string, string) {
+	// Example with the default rule:
+	// babyy-risk-13233-2332.txt -> 13233-2332, baby
+	// candyy-risk-13233-2332.txt -> 13233-2332, candy
+	return rule.match(fileName)
+}
+
+// transactionTask is the comparison of one trade in one directory.
+type transactionTask struct {
+	transaction int // Index into the compared transactions.
+	dir         string
+}
+
+// transactionOutcome is the result of a transactionTask.
+type transactionOutcome struct {
+	comparison *TransactionComparison
+	issues     []TransactionIssue
 }
 
-func parseTransactionFileName(fileName string) (string, string) {
-	// Example: babyy-risk-13233-2332.txt -> 13233-2332, baby
-	// Example: candyy-risk-13233-2332.txt -> 13233-2332, candy
+// compareTransactionFiles diffs the two sides of every trade in each
+// directory on req.workers goroutines. Results keep the order of the
+// transactions and their directories regardless of which finishes first.
+// It stops with the context's error when ctx is cancelled; progress, when
+// set, is called before the first and after each completed trade.
+func compareTransactionFiles(ctx context.Context, transactions []TransactionInfo, req archiveCompareRequest, progress func(done, total int)) ([]TransactionComparison, []TransactionIssue, error) {
+	var tasks []transactionTask
+	remaining := make([]int, len(transactions))
+	for i, transaction := range transactions {
+		for _, dir := range transaction.Directories {
+			tasks = append(tasks, transactionTask{transaction: i, dir: dir})
+		}
+		remaining[i] = len(transaction.Directories)
+	}
 
-	// Remove extension.
-	name := strings.TrimSuffix(fileName, ".txt")
+	if progress != nil {
+		progress(0, len(transactions))
+	}
 
-	// Determine file type.
-	if strings.HasPrefix(name, "babyy-risk-") {
-		transactionID := strings.TrimPrefix(name, "babyy-risk-")
-		return transactionID, "baby"
+	outcomes := make([]transactionOutcome, len(tasks))
+	next := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+
+	for w := 0; w < req.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				task := tasks[i]
+				outcomes[i] = compareTransactionTask(ctx, transactions[task.transaction], task.dir, req)
+
+				mu.Lock()
+				if remaining[task.transaction]--; remaining[task.transaction] == 0 {
+					done++
+					if progress != nil {
+						progress(done, len(transactions))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
 	}
 
-	if strings.HasPrefix(name, "candyy-risk-") {
-		transactionID := strings.TrimPrefix(name, "candyy-risk-")
-		return transactionID, "candy"
+feed:
+	for i := range tasks {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
 	}
+	close(next)
+	wg.Wait()
 
-	return "", ""
-}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
 
-func compareTransactionFiles(extractDir string, transactions []TransactionInfo) ([]TransactionComparison, error) {
 	var comparisons []TransactionComparison
+	issues := []TransactionIssue{}
+	for _, outcome := range outcomes {
+		if outcome.comparison != nil {
+			comparisons = append(comparisons, *outcome.comparison)
+		}
+		issues = append(issues, outcome.issues...)
+	}
 
-	for _, transaction := range transactions {
-		// Compare files in each directory for this transaction.
-		for _, dir := range transaction.Directories {
-			var babyFile, candyFile string
-			var babyContent, candyContent string
-
-			// Locate baby and candy files within the directory.
-			for _, file := range transaction.Files {
-				if file.Directory == dir {
-					content, err := readFileContent(file.FilePath)
-					if err != nil {
-						continue
-					}
+	return comparisons, issues, nil
+}
 
-					if file.Type == "baby" {
-						babyFile = file.FileName
-						babyContent = content
-					} else if file.Type == "candy" {
-						candyFile = file.FileName
-						candyContent = content
-					}
-				}
-			}
+// compareTransactionTask compares one trade in one directory, giving up after
+// req.timeout so a pathological file cannot stall the batch. The diff itself
+// stops at the deadline or when ctx is cancelled, so no work outlives its
+// worker.
+func compareTransactionTask(ctx context.Context, transaction TransactionInfo, dir string, req archiveCompareRequest) transactionOutcome {
+	taskCtx, cancel := context.WithTimeout(ctx, req.timeout)
+	defer cancel()
 
-			// Compare when both files are present.
-			if babyFile != "" && candyFile != "" {
-				// Generate diff.
-				dmp := diffmatchpatch.New()
-				diffs := dmp.DiffMain(babyContent, candyContent, true)
-				diffHTML := dmp.DiffPrettyHtml(diffs)
-
-				// Build line-by-line comparison.
-				lines1 := strings.Split(babyContent, "\n")
-				lines2 := strings.Split(candyContent, "\n")
-				diffLines := generateLineByLineDiff(lines1, lines2)
-
-				comparison := TransactionComparison{
-					TransactionID: transaction.ID,
-					Directory:     dir,
-					BabyFile:      babyFile,
-					CandyFile:     candyFile,
-					BabyContent:   babyContent,
-					CandyContent:  candyContent,
-					DiffHTML:      diffHTML,
-					DiffLines:     diffLines,
-				}
+	outcome, err := compareTransactionDir(taskCtx, transaction, dir, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return transactionOutcome{}
+		}
+		return transactionOutcome{issues: []TransactionIssue{{
+			TransactionID: transaction.ID,
+			Directory:     dir,
+			Type:          issueComparisonTimeout,
+			Reason:        fmt.Sprintf("comparing trade %s in %s took longer than %s", transaction.ID, dir, req.timeout),
+		}}}
+	}
+	return outcome
+}
+
+// compareTransactionDir diffs the two sides of a trade in one directory.
+// Files that cannot be compared are reported as issues: the side without a
+// counterpart, extra files mapping to an already chosen side, and files that
+// cannot be read. Only the detail fields selected by req.selection are
+// computed. The diff gives up with ctx's error once ctx is done.
+func compareTransactionDir(ctx context.Context, transaction TransactionInfo, dir string, req archiveCompareRequest) (transactionOutcome, error) {
+	rule, opts := req.rule, req.opts
+	var outcome transactionOutcome
+	sides, unreadable := readTransactionSides(transaction, dir, func(issue TransactionIssue) {
+		outcome.issues = append(outcome.issues, issue)
+	})
 
-				comparisons = append(comparisons, comparison)
+	baby, hasBaby := sides[rule.LeftLabel]
+	candy, hasCandy := sides[rule.RightLabel]
+	if !hasBaby || !hasCandy {
+		present, missing := baby, rule.RightLabel
+		if !hasBaby {
+			present, missing = candy, rule.LeftLabel
+		}
+		if hasBaby || hasCandy {
+			reason := fmt.Sprintf("no %s file for trade %s in %s", missing, transaction.ID, dir)
+			if unreadable[missing] {
+				reason = fmt.Sprintf("the %s file for trade %s in %s is unreadable", missing, transaction.ID, dir)
 			}
+			outcome.issues = append(outcome.issues, newTransactionIssue(transaction.ID, present.file, issueMissingCounterpart, reason))
+		}
+		return outcome, nil
+	}
+	babyContent, candyContent := baby.content, candy.content
+
+	fields := req.selection.fields
+
+	// Build line-by-line comparison.
+	lines1 := strings.Split(babyContent, "\n")
+	lines2 := strings.Split(candyContent, "\n")
+	diffLines, numeric, err := generateLineByLineDiffContext(ctx, lines1, lines2, opts)
+	if err != nil {
+		return outcome, err
+	}
+
+	comparison := TransactionComparison{
+		TransactionID: transaction.ID,
+		Directory:     dir,
+		LeftLabel:     rule.LeftLabel,
+		RightLabel:    rule.RightLabel,
+		BabyFile:      baby.file.FileName,
+		CandyFile:     candy.file.FileName,
+		BabyContent:   babyContent,
+		CandyContent:  candyContent,
+		DiffLines:     diffLines,
+		ChangedLines:  countChangedLines(diffLines),
+		Numeric:       numeric,
+	}
+	comparison.Status = comparisonIdentical
+	if comparison.ChangedLines > 0 {
+		comparison.Status = comparisonDifferent
+	}
+
+	// Character diff of the whole files.
+	if fields["diff_html"] {
+		dmp := newDiffMatchPatch(ctx)
+		comparison.DiffHTML = dmp.DiffPrettyHtml(dmp.DiffMain(babyContent, candyContent, true))
+		if err := ctx.Err(); err != nil {
+			return outcome, err
+		}
+	}
+	if fields["measures"] && req.format != nil {
+		comparison.Measures = compareRiskMeasures(req.format, lines1, lines2, opts)
+	}
+
+	comparison = comparison.selectFields(req.selection)
+	outcome.comparison = &comparison
+	return outcome, nil
+}
+
+// transactionSide is the file chosen for one side of a trade in a directory.
+type transactionSide struct {
+	file    TransactionFile
+	content string
+}
+
+// readTransactionSides reads the first readable file of each side of a trade
+// in a directory. Further files of a side and unreadable files are passed to
+// report; the returned set marks the sides with an unreadable file.
+func readTransactionSides(transaction TransactionInfo, dir string, report func(TransactionIssue)) (map[string]transactionSide, map[string]bool) {
+	sides := make(map[string]transactionSide, 2)
+	unreadable := make(map[string]bool, 2)
+
+	for _, file := range transaction.Files {
+		if file.Directory != dir {
+			continue
+		}
+		if chosen, ok := sides[file.Type]; ok {
+			reason := fmt.Sprintf("duplicate %s file for trade %s; %s is compared instead", file.Type, transaction.ID, chosen.file.FileName)
+			report(newTransactionIssue(transaction.ID, file, issueDuplicateFile, reason))
+			continue
 		}
+		content, err := readFileContent(file.FilePath)
+		if err != nil {
+			unreadable[file.Type] = true
+			report(newTransactionIssue(transaction.ID, file, issueUnreadableFile, readErrorReason(err)))
+			continue
+		}
+		sides[file.Type] = transactionSide{file: file, content: content}
 	}
 
-	return comparisons, nil
+	return sides, unreadable
+}
+
+func newTransactionIssue(transactionID string, file TransactionFile, issueType, reason string) TransactionIssue {
+	return TransactionIssue{
+		TransactionID: transactionID,
+		Directory:     file.Directory,
+		Type:          issueType,
+		Side:          file.Type,
+		File:          file.FileName,
+		Reason:        reason,
+	}
+}
+
+// readErrorReason describes a read failure without exposing server paths.
+func readErrorReason(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return "failed to read file: " + err.Error()
 }
@@ -0,0 +1,202 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPairingRule returns the default pairing rule without reading config/.
+func testPairingRule(tb testing.TB) PairingRule {
+	tb.Helper()
+	rule := pairingRules.defaults[0]
+	if err := rule.compile(); err != nil {
+		tb.Fatal(err)
+	}
+	return rule
+}
+
+// writeTradeFiles writes the baby and candy files of a trade.
+func writeTradeFiles(tb testing.TB, root, dir, id, baby, candy string) {
+	tb.Helper()
+	if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	for name, content := range map[string]string{"babyy-risk-" + id + ".txt": baby, "candyy-risk-" + id + ".txt": candy} {
+		if err := os.WriteFile(filepath.Join(root, dir, name), []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// writeSyntheticArchive writes an extracted archive of trades spread over
+// three directories; every fourth trade has a few changed measures.
+func writeSyntheticArchive(tb testing.TB, root string, trades int) {
+	tb.Helper()
+	rng := rand.New(rand.NewSource(1))
+	dirs := []string{"ABC", "ABD", "ABE"}
+	for i := 0; i < trades; i++ {
+		var baby, candy strings.Builder
+		for m := 0; m < 40; m++ {
+			value := rng.Float64() * 1e6
+			fmt.Fprintf(&baby, "Measure_%d=%.4f\n", m, value)
+			if i%4 == 0 && m%10 == 0 {
+				value *= 1.01
+			}
+			fmt.Fprintf(&candy, "Measure_%d=%.4f\n", m, value)
+		}
+		writeTradeFiles(tb, root, dirs[i%len(dirs)], fmt.Sprint(i), baby.String(), candy.String())
+	}
+}
+
+// newTestArchiveRequest analyses an extracted archive for comparison.
+func newTestArchiveRequest(tb testing.TB, root string, workers int, timeout time.Duration) (archiveCompareRequest, []TransactionInfo) {
+	tb.Helper()
+	req := archiveCompareRequest{
+		archive: uploadEntry{Path: root, Name: "synthetic.zip"},
+		rule:    testPairingRule(tb),
+		workers: workers,
+		timeout: timeout,
+	}
+	_, transactions, err := analyzeExtractedArchive(root, req.rule)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return req, transactions
+}
+
+func TestCompareTransactionFilesOrder(t *testing.T) {
+	root := t.TempDir()
+	writeSyntheticArchive(t, root, 200)
+
+	var want []TransactionComparison
+	for _, workers := range []int{1, 3, 16} {
+		req, transactions := newTestArchiveRequest(t, root, workers, time.Minute)
+		comparisons, issues, err := compareTransactionFiles(context.Background(), transactions, req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comparisons) != 200 || len(issues) != 0 {
+			t.Fatalf("workers=%d: %d comparisons and %d issues, want 200 and 0", workers, len(comparisons), len(issues))
+		}
+		if want == nil {
+			want = comparisons
+		} else if !reflect.DeepEqual(comparisons, want) {
+			t.Errorf("workers=%d: comparisons differ from workers=1", workers)
+		}
+	}
+}
+
+// pathologicalLines returns n lines over a two-letter alphabet, which makes
+// the line diff slow.
+func pathologicalLines(rng *rand.Rand, n int) string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = string(rune('a' + rng.Intn(2)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestCompareTransactionFilesTimeoutStopsDiff(t *testing.T) {
+	root := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 4; i++ {
+		writeTradeFiles(t, root, "ABC", fmt.Sprint(i), pathologicalLines(rng, 20000), pathologicalLines(rng, 20000))
+	}
+	req, transactions := newTestArchiveRequest(t, root, 2, time.Millisecond)
+
+	before := runtime.NumGoroutine()
+	start := time.Now()
+	comparisons, issues, err := compareTransactionFiles(context.Background(), transactions, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comparisons) != 0 || len(issues) != 4 {
+		t.Fatalf("%d comparisons and %d issues, want 0 and 4", len(comparisons), len(issues))
+	}
+	for _, issue := range issues {
+		if issue.Type != issueComparisonTimeout {
+			t.Errorf("issue %+v, want a %s issue", issue, issueComparisonTimeout)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timed-out comparisons took %s", elapsed)
+	}
+
+	// Timed-out diffs must not keep running in the background.
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines left running after the comparison, had %d", after, before)
+	}
+}
+
+func TestCompareTransactionFilesCancelled(t *testing.T) {
+	root := t.TempDir()
+	writeSyntheticArchive(t, root, 50)
+	req, transactions := newTestArchiveRequest(t, root, 2, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := compareTransactionFiles(ctx, transactions, req, nil); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func BenchmarkCompareTransactionFiles(b *testing.B) {
+	root := b.TempDir()
+	writeSyntheticArchive(b, root, 5000)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			req, transactions := newTestArchiveRequest(b, root, workers, archiveCompareDefaultTimeout)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := compareTransactionFiles(context.Background(), transactions, req, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareTransactionDirSelection(t *testing.T) {
+	root := t.TempDir()
+	writeTradeFiles(t, root, "ABC", "1", "PV=1\nDelta=2\n", "PV=1.5\nDelta=2\n")
+	req, transactions := newTestArchiveRequest(t, root, 1, time.Minute)
+
+	// Summary comparisons keep no contents or diffs.
+	outcome, err := compareTransactionDir(context.Background(), transactions[0], "ABC", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := outcome.comparison
+	if summary.Status != comparisonDifferent || summary.ChangedLines != 1 {
+		t.Errorf("got status %s with %d changed lines, want different with 1", summary.Status, summary.ChangedLines)
+	}
+	if summary.BabyContent != "" || summary.CandyContent != "" || summary.DiffHTML != "" || summary.DiffLines != nil || summary.Hunks != nil {
+		t.Errorf("summary comparison carries detail fields: %+v", summary)
+	}
+
+	req.selection = newComparisonSelection(diffDefaultContext, "diff_html", "hunks")
+	outcome, err = compareTransactionDir(context.Background(), transactions[0], "ABC", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detail := outcome.comparison
+	if detail.DiffHTML == "" || len(detail.Hunks) != 1 {
+		t.Errorf("got diff_html %q and %d hunks, want both", detail.DiffHTML, len(detail.Hunks))
+	}
+	if detail.BabyContent != "" || detail.DiffLines != nil {
+		t.Errorf("unselected fields were kept: %+v", detail)
+	}
+}
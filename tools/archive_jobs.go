@@ -0,0 +1,357 @@
+package tools
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// archiveJobWorkers bounds the number of archive comparisons running at
+	// once; further jobs wait in a queue of archiveJobQueueSize.
+	archiveJobWorkers   = 2
+	archiveJobQueueSize = 100
+
+	// archiveJobRetention is how long finished jobs and their results are kept.
+	archiveJobRetention = time.Hour
+)
+
+// Archive job states.
+const (
+	archiveJobQueued    = "queued"
+	archiveJobRunning   = "running"
+	archiveJobCompleted = "completed"
+	archiveJobFailed    = "failed"
+	archiveJobCancelled = "cancelled"
+)
+
+var errArchiveJobQueueFull = errors.New("too many archive comparison jobs are queued, try again later")
+
+// ArchiveJobStatus reports the state and progress of an archive comparison job.
+type ArchiveJobStatus struct {
+	ID         string     `json:"id"`
+	State      string     `json:"state"`
+	Done       int        `json:"done"`     // Trades compared so far.
+	Total      int        `json:"total"`    // Trades in the archive, once known.
+	Progress   float64    `json:"progress"` // Between 0 and 1.
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// finished reports whether the job has reached a final state.
+func (s ArchiveJobStatus) finished() bool {
+	return s.State == archiveJobCompleted || s.State == archiveJobFailed || s.State == archiveJobCancelled
+}
+
+// archiveJob is one submitted archive comparison.
+type archiveJob struct {
+	req    archiveCompareRequest
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	status  ArchiveJobStatus
+	result  *ArchiveCompareResult
+	changed chan struct{} // Closed and replaced on every status change.
+}
+
+// update applies fn to the job status and wakes up its watchers.
+func (j *archiveJob) update(fn func(*ArchiveJobStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fn(&j.status)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// snapshot returns the current status and a channel closed on its next change.
+func (j *archiveJob) snapshot() (ArchiveJobStatus, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.status, j.changed
+}
+
+// finish records the outcome of a job.
+func (j *archiveJob) finish(result *ArchiveCompareResult, err error) {
+	j.update(func(s *ArchiveJobStatus) {
+		j.result = result
+		now := time.Now()
+		s.FinishedAt = &now
+		switch {
+		case j.ctx.Err() != nil:
+			s.State = archiveJobCancelled
+		case err != nil:
+			s.State = archiveJobFailed
+			s.Error = err.Error()
+		default:
+			s.State = archiveJobCompleted
+		}
+	})
+}
+
+// archiveJobQueue runs archive comparisons on a bounded pool of workers and
+// remembers their status until archiveJobRetention after they finish.
+type archiveJobQueue struct {
+	mu    sync.Mutex
+	jobs  map[string]*archiveJob
+	queue chan *archiveJob
+	start sync.Once
+}
+
+var archiveJobs = &archiveJobQueue{
+	jobs:  make(map[string]*archiveJob),
+	queue: make(chan *archiveJob, archiveJobQueueSize),
+}
+
+// Submit queues a comparison and returns its job.
+func (q *archiveJobQueue) Submit(req archiveCompareRequest) (*archiveJob, error) {
+	q.start.Do(func() {
+		for i := 0; i < archiveJobWorkers; i++ {
+			go q.work()
+		}
+	})
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+
+	id := hex.EncodeToString(raw)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &archiveJob{
+		req:     req,
+		ctx:     ctx,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		status: ArchiveJobStatus{
+			ID:        id,
+			State:     archiveJobQueued,
+			CreatedAt: time.Now(),
+		},
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	select {
+	case q.queue <- job:
+	default:
+		cancel()
+		return nil, errArchiveJobQueueFull
+	}
+	q.jobs[id] = job
+	return job, nil
+}
+
+// prune forgets jobs that finished more than archiveJobRetention ago.
+// Callers hold q.mu.
+func (q *archiveJobQueue) prune() {
+	for id, job := range q.jobs {
+		status, _ := job.snapshot()
+		if status.FinishedAt != nil && time.Since(*status.FinishedAt) > archiveJobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// Get returns the job with the given ID.
+func (q *archiveJobQueue) Get(id string) (*archiveJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	return job, ok
+}
+
+// Cancel stops a queued or running job and reports whether it was still
+// unfinished.
+func (q *archiveJobQueue) Cancel(job *archiveJob) bool {
+	cancelled := false
+	job.update(func(s *ArchiveJobStatus) {
+		if s.finished() {
+			return
+		}
+		cancelled = true
+		job.cancel()
+		if s.State == archiveJobQueued {
+			// Running jobs are marked cancelled by their worker.
+			now := time.Now()
+			s.State = archiveJobCancelled
+			s.FinishedAt = &now
+		}
+	})
+	return cancelled
+}
+
+// work runs queued jobs until the process exits.
+func (q *archiveJobQueue) work() {
+	for job := range q.queue {
+		started := false
+		job.update(func(s *ArchiveJobStatus) {
+			if s.State != archiveJobQueued {
+				return // Cancelled while queued.
+			}
+			now := time.Now()
+			s.State = archiveJobRunning
+			s.StartedAt = &now
+			started = true
+		})
+		if !started {
+			continue
+		}
+
+		result, err := runArchiveCompare(job.ctx, job.req, func(done, total int) {
+			job.update(func(s *ArchiveJobStatus) {
+				s.Done, s.Total = done, total
+				if total > 0 {
+					s.Progress = float64(done) / float64(total)
+				}
+			})
+		})
+		if err != nil {
+			job.finish(nil, err)
+		} else {
+			job.finish(&result, nil)
+		}
+	}
+}
+
+// lookupArchiveJob returns the job named by the id path parameter, writing a
+// 404 response when it does not exist.
+func lookupArchiveJob(c *gin.Context) (*archiveJob, bool) {
+	job, ok := archiveJobs.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+	}
+	return job, ok
+}
+
+// HandleArchiveJobSubmit queues an archive comparison. The job result keeps
+// only the detail fields selected here, so summary jobs hold no file contents.
+func HandleArchiveJobSubmit(c *gin.Context) {
+	req, ok := parseArchiveCompareRequest(c)
+	if !ok {
+		return
+	}
+
+	var err error
+	if req.selection, err = parseComparisonSelection(c, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	job, err := archiveJobs.Submit(req)
+	if errors.Is(err, errArchiveJobQueueFull) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to submit job: " + err.Error()})
+		return
+	}
+
+	status, _ := job.snapshot()
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id": status.ID,
+		"status": status,
+	})
+}
+
+func HandleArchiveJobStatus(c *gin.Context) {
+	job, ok := lookupArchiveJob(c)
+	if !ok {
+		return
+	}
+
+	status, _ := job.snapshot()
+	c.JSON(http.StatusOK, status)
+}
+
+// HandleArchiveJobResult returns the result of a completed job. The fields
+// parameter can narrow the detail fields selected when the job was submitted.
+func HandleArchiveJobResult(c *gin.Context) {
+	job, ok := lookupArchiveJob(c)
+	if !ok {
+		return
+	}
+
+	selection, err := parseComparisonSelection(c, "")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	_, narrow := c.GetQuery("fields")
+
+	status, _ := job.snapshot()
+	switch status.State {
+	case archiveJobCompleted:
+		job.mu.Lock()
+		result := *job.result
+		job.mu.Unlock()
+		if narrow {
+			result = result.selectFields(selection)
+		}
+		c.JSON(http.StatusOK, result)
+	case archiveJobFailed:
+		c.JSON(http.StatusConflict, gin.H{"error": "job failed: " + status.Error, "status": status})
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": "job is " + status.State, "status": status})
+	}
+}
+
+func HandleArchiveJobCancel(c *gin.Context) {
+	job, ok := lookupArchiveJob(c)
+	if !ok {
+		return
+	}
+
+	if !archiveJobs.Cancel(job) {
+		status, _ := job.snapshot()
+		c.JSON(http.StatusConflict, gin.H{"error": "job is already " + status.State, "status": status})
+		return
+	}
+
+	status, _ := job.snapshot()
+	c.JSON(http.StatusOK, gin.H{
+		"message": "job cancellation requested",
+		"status":  status,
+	})
+}
+
+// HandleArchiveJobEvents streams the job status as Server-Sent Events: a
+// "progress" event on every change and a final "done" event once the job
+// has finished.
+func HandleArchiveJobEvents(c *gin.Context) {
+	job, ok := lookupArchiveJob(c)
+	if !ok {
+		return
+	}
+
+	c.Stream(func(w io.Writer) bool {
+		status, changed := job.snapshot()
+		if status.finished() {
+			c.SSEvent("done", status)
+			return false
+		}
+		c.SSEvent("progress", status)
+
+		select {
+		case <-changed:
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
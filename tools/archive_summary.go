@@ -0,0 +1,146 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	archiveSummaryDefaultTop = 20
+	archiveSummaryMaxTop     = 1000
+)
+
+// changedLineBuckets are the inclusive upper bounds of the changed-lines
+// histogram; a final open-ended bucket collects everything larger.
+var changedLineBuckets = []int{0, 5, 10, 50, 100, 500, 1000}
+
+// ArchiveSummary aggregates the comparisons of an archive so large batches
+// can be reviewed without reading every trade.
+type ArchiveSummary struct {
+	Totals      DirectorySummary     `json:"totals"`
+	Directories []DirectorySummary   `json:"directories"`
+	TopChanged  []ChangedTransaction `json:"top_changed"`
+	Histogram   []ChangedLinesBin    `json:"changed_lines_histogram"`
+	Unpaired    []TransactionIssue   `json:"unpaired"` // Files whose counterpart is missing.
+}
+
+// DirectorySummary counts trade outcomes in one directory, or in the whole
+// archive for the totals.
+type DirectorySummary struct {
+	Directory  string `json:"directory,omitempty"`
+	Identical  int    `json:"identical"`
+	Different  int    `json:"different"`
+	Unpaired   int    `json:"unpaired"`
+	Duplicate  int    `json:"duplicate"`
+	Unreadable int    `json:"unreadable"`
+	TimedOut   int    `json:"timed_out"`
+}
+
+type ChangedTransaction struct {
+	TransactionID string `json:"transaction_id"`
+	Directory     string `json:"directory"`
+	ChangedLines  int    `json:"changed_lines"`
+}
+
+// ChangedLinesBin counts the compared trades whose number of changed lines
+// falls within [Min, Max]; Max is omitted for the open-ended last bin.
+type ChangedLinesBin struct {
+	Label string `json:"label"`
+	Min   int    `json:"min"`
+	Max   *int   `json:"max,omitempty"`
+	Count int    `json:"count"`
+}
+
+// summarizeArchive builds the summary of an archive comparison, listing at
+// most top trades by changed lines.
+func summarizeArchive(comparisons []TransactionComparison, issues []TransactionIssue, top int) ArchiveSummary {
+	summary := ArchiveSummary{
+		Directories: []DirectorySummary{},
+		TopChanged:  []ChangedTransaction{},
+		Histogram:   newChangedLinesHistogram(),
+		Unpaired:    []TransactionIssue{},
+	}
+	directories := make(map[string]*DirectorySummary)
+	directory := func(name string) *DirectorySummary {
+		if directories[name] == nil {
+			directories[name] = &DirectorySummary{Directory: name}
+		}
+		return directories[name]
+	}
+
+	var changed []ChangedTransaction
+	for _, comparison := range comparisons {
+		dir := directory(comparison.Directory)
+		if comparison.ChangedLines == 0 {
+			dir.Identical++
+		} else {
+			dir.Different++
+			changed = append(changed, ChangedTransaction{
+				TransactionID: comparison.TransactionID,
+				Directory:     comparison.Directory,
+				ChangedLines:  comparison.ChangedLines,
+			})
+		}
+		summary.Histogram[changedLinesBin(comparison.ChangedLines)].Count++
+	}
+
+	for _, issue := range issues {
+		dir := directory(issue.Directory)
+		switch issue.Type {
+		case issueMissingCounterpart:
+			dir.Unpaired++
+			summary.Unpaired = append(summary.Unpaired, issue)
+		case issueDuplicateFile:
+			dir.Duplicate++
+		case issueUnreadableFile:
+			dir.Unreadable++
+		case issueComparisonTimeout:
+			dir.TimedOut++
+		}
+	}
+
+	for _, dir := range directories {
+		summary.Directories = append(summary.Directories, *dir)
+		summary.Totals.Identical += dir.Identical
+		summary.Totals.Different += dir.Different
+		summary.Totals.Unpaired += dir.Unpaired
+		summary.Totals.Duplicate += dir.Duplicate
+		summary.Totals.Unreadable += dir.Unreadable
+		summary.Totals.TimedOut += dir.TimedOut
+	}
+	sort.Slice(summary.Directories, func(i, j int) bool {
+		return summary.Directories[i].Directory < summary.Directories[j].Directory
+	})
+
+	sort.SliceStable(changed, func(i, j int) bool {
+		return changed[i].ChangedLines > changed[j].ChangedLines
+	})
+	if len(changed) > top {
+		changed = changed[:top]
+	}
+	summary.TopChanged = append(summary.TopChanged, changed...)
+
+	return summary
+}
+
+// newChangedLinesHistogram returns the empty bins of the changed-lines
+// histogram.
+func newChangedLinesHistogram() []ChangedLinesBin {
+	bins := make([]ChangedLinesBin, 0, len(changedLineBuckets)+1)
+	lower := 0
+	for _, upper := range changedLineBuckets {
+		upper := upper
+		label := fmt.Sprintf("%d-%d", lower, upper)
+		if lower == upper {
+			label = fmt.Sprint(upper)
+		}
+		bins = append(bins, ChangedLinesBin{Label: label, Min: lower, Max: &upper})
+		lower = upper + 1
+	}
+	return append(bins, ChangedLinesBin{Label: fmt.Sprintf("%d+", lower), Min: lower})
+}
+
+// changedLinesBin returns the histogram bin index for a changed-lines count.
+func changedLinesBin(changedLines int) int {
+	return sort.SearchInts(changedLineBuckets, changedLines)
+}
@@ -0,0 +1,296 @@
+package tools
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testExtractLimits keeps the crafted archives small.
+var testExtractLimits = extractLimits{
+	MaxEntries:   10,
+	MaxEntrySize: 4 << 20,
+	MaxTotalSize: 6 << 20,
+	MaxRatio:     200,
+}
+
+// testArchiveEntry is one entry of a crafted archive.
+type testArchiveEntry struct {
+	name     string
+	body     []byte
+	typeflag byte        // Tar entry type; tar.TypeReg when zero.
+	mode     os.FileMode // Zip entry mode; 0644 when zero.
+	linkname string
+}
+
+func writeTestZip(t *testing.T, path string, entries []testArchiveEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		mode := entry.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		header.SetMode(mode)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(entry.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTar(t *testing.T, path string, entries []testArchiveEntry, compress bool) {
+	t.Helper()
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	tw := tar.NewWriter(&buf)
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Mode:     0644,
+			Size:     int64(len(entry.body)),
+			Linkname: entry.linkname,
+		}
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if header.Typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.body[:header.Size]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// manyEntries returns n small file entries.
+func manyEntries(n int) []testArchiveEntry {
+	entries := make([]testArchiveEntry, n)
+	for i := range entries {
+		entries[i] = testArchiveEntry{name: fmt.Sprintf("ABC/file-%d.txt", i), body: []byte("x")}
+	}
+	return entries
+}
+
+// checkNothingOutside fails if anything but the archive and dest exists in root.
+func checkNothingOutside(t *testing.T, root, archive, dest string) {
+	t.Helper()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || path == archive {
+			return nil
+		}
+		if path == dest {
+			return filepath.SkipDir
+		}
+		t.Errorf("extraction wrote %s outside the destination", path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchiveRejectsMaliciousArchives(t *testing.T) {
+	zeros := bytes.Repeat([]byte{0}, 3<<20)
+
+	// Size checks without the ratio check, which zeros would trip first.
+	noRatio := testExtractLimits
+	noRatio.MaxRatio = 1e6
+	smallTotal := noRatio
+	smallTotal.MaxTotalSize = 1536 << 10
+	tests := []struct {
+		name    string
+		format  string // "zip", "tar" or "tar.gz".
+		entries []testArchiveEntry
+		limits  *extractLimits
+		reason  string
+	}{
+		{"zip parent traversal", "zip", []testArchiveEntry{{name: "../evil.txt", body: []byte("x")}}, nil, "escapes"},
+		{"zip nested traversal", "zip", []testArchiveEntry{{name: "ABC/../../evil.txt", body: []byte("x")}}, nil, "escapes"},
+		{"zip backslash traversal", "zip", []testArchiveEntry{{name: `ABC\..\..\evil.txt`, body: []byte("x")}}, nil, "escapes"},
+		{"zip absolute path", "zip", []testArchiveEntry{{name: "/tmp/evil.txt", body: []byte("x")}}, nil, "absolute paths"},
+		{"zip symlink", "zip", []testArchiveEntry{{name: "link", body: []byte("/etc/passwd"), mode: os.ModeSymlink | 0777}}, nil, "symbolic links"},
+		{"zip too many entries", "zip", manyEntries(11), nil, "entries"},
+		{"zip entry too large", "zip", []testArchiveEntry{{name: "big.txt", body: bytes.Repeat([]byte("a"), 5<<20)}}, &noRatio, "uncompressed size exceeds"},
+		{"zip total too large", "zip", []testArchiveEntry{{name: "a.txt", body: zeros[:1<<20]}, {name: "b.txt", body: zeros[:1<<20]}}, &smallTotal, "total uncompressed size"},
+		{"zip bomb", "zip", []testArchiveEntry{{name: "bomb.txt", body: zeros}}, nil, "compression ratio"},
+		{"tar parent traversal", "tar", []testArchiveEntry{{name: "../evil.txt", body: []byte("x")}}, nil, "escapes"},
+		{"tar traversal directory", "tar", []testArchiveEntry{{name: "../evil", typeflag: tar.TypeDir}}, nil, "escapes"},
+		{"tar absolute path", "tar", []testArchiveEntry{{name: "/tmp/evil.txt", body: []byte("x")}}, nil, "absolute paths"},
+		{"tar symlink", "tar", []testArchiveEntry{{name: "link", typeflag: tar.TypeSymlink, linkname: "../../etc/passwd"}}, nil, "links are not allowed"},
+		{"tar hardlink", "tar", []testArchiveEntry{{name: "ok.txt", body: []byte("x")}, {name: "link", typeflag: tar.TypeLink, linkname: "/etc/passwd"}}, nil, "links are not allowed"},
+		{"tar too many entries", "tar", manyEntries(11), nil, "more than 10 entries"},
+		{"tar entry too large", "tar", []testArchiveEntry{{name: "big.txt", body: bytes.Repeat([]byte("a"), 5<<20)}}, nil, "uncompressed size exceeds"},
+		{"tar total too large", "tar", []testArchiveEntry{{name: "a.txt", body: zeros[:3<<20]}, {name: "b.txt", body: zeros[:3<<20]}, {name: "c.txt", body: zeros[:3<<20]}}, &noRatio, "total uncompressed size"},
+		{"tar.gz bomb", "tar.gz", []testArchiveEntry{{name: "bomb.txt", body: zeros}}, nil, "compression ratio"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			archive := filepath.Join(root, "archive."+tt.format)
+			dest := filepath.Join(root, "dest")
+			if tt.format == "zip" {
+				writeTestZip(t, archive, tt.entries)
+			} else {
+				writeTestTar(t, archive, tt.entries, tt.format == "tar.gz")
+			}
+
+			limits := testExtractLimits
+			if tt.limits != nil {
+				limits = *tt.limits
+			}
+			err := extractArchiveWithLimits(archive, dest, limits)
+			var rejection *archiveRejection
+			if !errors.As(err, &rejection) {
+				t.Fatalf("got error %v, want an archive rejection", err)
+			}
+			if !strings.Contains(rejection.Reason, tt.reason) {
+				t.Errorf("rejected for %q, want a reason containing %q", rejection.Reason, tt.reason)
+			}
+			if !isArchiveClientError(err) {
+				t.Errorf("rejection %v is not a client error", err)
+			}
+			checkNothingOutside(t, root, archive, dest)
+		})
+	}
+}
+
+func TestExtractArchiveRemovesPartialOutput(t *testing.T) {
+	root := t.TempDir()
+	archive := filepath.Join(root, "archive.tar")
+	dest := filepath.Join(root, "dest")
+	writeTestTar(t, archive, []testArchiveEntry{
+		{name: "ABC/babyy-risk-1.txt", body: []byte("PV=1\n")},
+		{name: "../evil.txt", body: []byte("x")},
+	}, false)
+
+	if err := extractArchive(archive, dest); err == nil {
+		t.Fatal("extractArchive accepted a traversal entry")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("partial extraction left %s behind", dest)
+	}
+	checkNothingOutside(t, root, archive, dest)
+}
+
+func TestExtractArchiveAcceptsSafeArchives(t *testing.T) {
+	entries := []testArchiveEntry{
+		{name: "ABC/", typeflag: tar.TypeDir, mode: os.ModeDir | 0755},
+		{name: "ABC/babyy-risk-1.txt", body: []byte("PV=1\n")},
+		{name: "ABD/candyy-risk-1.txt", body: []byte("PV=2\n")},
+		{name: "notes/..hidden", body: []byte("dots are fine\n")},
+	}
+	for _, format := range []string{"zip", "tar", "tar.gz"} {
+		t.Run(format, func(t *testing.T) {
+			root := t.TempDir()
+			archive := filepath.Join(root, "archive."+format)
+			dest := filepath.Join(root, "dest")
+			if format == "zip" {
+				writeTestZip(t, archive, entries)
+			} else {
+				writeTestTar(t, archive, entries, format == "tar.gz")
+			}
+
+			if err := extractArchiveWithLimits(archive, dest, testExtractLimits); err != nil {
+				t.Fatalf("extractArchiveWithLimits: %v", err)
+			}
+			for _, entry := range entries[1:] {
+				content, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(entry.name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(content, entry.body) {
+					t.Errorf("%s: got %q, want %q", entry.name, content, entry.body)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArchiveSkipsPAXGlobalHeader(t *testing.T) {
+	root := t.TempDir()
+	archive := filepath.Join(root, "archive.tar.gz")
+	dest := filepath.Join(root, "dest")
+
+	// Laid out like git archive --format=tar.gz output.
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	headers := []*tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "0123456789abcdef"}},
+		{Name: "ABC/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "ABC/babyy-risk-1.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	}
+	for _, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tw.Write([]byte("PV=1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The global header does not count against the entry limit.
+	limits := testExtractLimits
+	limits.MaxEntries = 2
+	if err := extractArchiveWithLimits(archive, dest, limits); err != nil {
+		t.Fatalf("extractArchiveWithLimits: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "pax_global_header")); !os.IsNotExist(err) {
+		t.Error("the global header was extracted as a file")
+	}
+	if content, err := os.ReadFile(filepath.Join(dest, "ABC", "babyy-risk-1.txt")); err != nil || string(content) != "PV=1\n" {
+		t.Errorf("got %q, %v, want the trade file", content, err)
+	}
+}
@@ -0,0 +1,154 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CompareOptions controls how lines are matched during a comparison.
+// Normalization only affects matching; results always show the original text.
+type CompareOptions struct {
+	Algorithm                DiffAlgorithm `json:"algorithm"`
+	IgnoreTrailingWhitespace bool          `json:"ignore_trailing_whitespace"`
+	IgnoreAllWhitespace      bool          `json:"ignore_whitespace"`
+	IgnoreCase               bool          `json:"ignore_case"`
+	NormalizeLineEndings     bool          `json:"normalize_line_endings"`
+	IgnoreBlankLines         bool          `json:"ignore_blank_lines"`
+	NumericTolerance         bool          `json:"numeric_tolerance"`
+	AbsTolerance             float64       `json:"abs_tolerance"`
+	RelTolerance             float64       `json:"rel_tolerance"`
+	RuleSet                  string        `json:"rule_set,omitempty"`
+
+	rules []IgnoreRule
+}
+
+// ignoredLineKey is the matching key shared by all lines excluded by an
+// ignore rule, so ignored lines on both sides still align with each other.
+const ignoredLineKey = "\x01ignored"
+
+// parseCompareOptions reads the comparison options from the query string.
+func parseCompareOptions(c *gin.Context) (CompareOptions, error) {
+	var opts CompareOptions
+	var err error
+
+	if opts.Algorithm, err = parseDiffAlgorithm(c.Query("algorithm")); err != nil {
+		return opts, err
+	}
+
+	flags := []struct {
+		name  string
+		value *bool
+	}{
+		{"ignore_trailing_whitespace", &opts.IgnoreTrailingWhitespace},
+		{"ignore_whitespace", &opts.IgnoreAllWhitespace},
+		{"ignore_case", &opts.IgnoreCase},
+		{"normalize_line_endings", &opts.NormalizeLineEndings},
+		{"ignore_blank_lines", &opts.IgnoreBlankLines},
+		{"numeric", &opts.NumericTolerance},
+	}
+	for _, flag := range flags {
+		raw := c.Query(flag.name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return opts, fmt.Errorf("invalid value for %s: %q", flag.name, raw)
+		}
+		*flag.value = value
+	}
+
+	if opts.RuleSet = c.Query("rule_set"); opts.RuleSet != "" {
+		set, err := lookupIgnoreRuleSet(opts.RuleSet)
+		if err != nil {
+			return opts, err
+		}
+		opts.rules = set.Rules
+	}
+
+	tolerances := []struct {
+		name  string
+		value *float64
+	}{
+		{"abs_tol", &opts.AbsTolerance},
+		{"rel_tol", &opts.RelTolerance},
+	}
+	for _, tolerance := range tolerances {
+		raw := c.Query(tolerance.name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || value < 0 {
+			return opts, fmt.Errorf("invalid value for %s: %q", tolerance.name, raw)
+		}
+		*tolerance.value = value
+	}
+
+	return opts, nil
+}
+
+// normalizeLine returns the key used to match a line against the other file.
+func (o CompareOptions) normalizeLine(line string) string {
+	for _, rule := range o.rules {
+		if rule.Action == IgnoreRuleActionMask {
+			line = rule.re.ReplaceAllString(line, rule.Replace)
+		}
+	}
+	if o.NormalizeLineEndings {
+		line = strings.TrimSuffix(line, "\r")
+	}
+	if o.IgnoreAllWhitespace {
+		line = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, line)
+	} else if o.IgnoreTrailingWhitespace {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+	if o.IgnoreCase {
+		line = strings.ToLower(line)
+	}
+	return line
+}
+
+// lineKeys returns the keys the diff engine matches lines on. In numeric
+// tolerance mode numbers are masked so the values can be checked separately.
+func (o CompareOptions) lineKeys(lines []string) []string {
+	keys := make([]string, len(lines))
+	for i, line := range lines {
+		if o.matchesIgnoreRule(line) {
+			keys[i] = ignoredLineKey
+			continue
+		}
+		keys[i] = o.normalizeLine(line)
+		if o.NumericTolerance {
+			keys[i] = maskNumbers(keys[i])
+		}
+	}
+	return keys
+}
+
+// matchesIgnoreRule reports whether an "ignore_line" rule matches the line.
+func (o CompareOptions) matchesIgnoreRule(line string) bool {
+	for _, rule := range o.rules {
+		if rule.Action == IgnoreRuleActionLine && rule.re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIgnoredLine reports whether an unmatched line should not count as a change.
+func (o CompareOptions) isIgnoredLine(line string) bool {
+	if o.IgnoreBlankLines && strings.TrimSpace(line) == "" {
+		return true
+	}
+	return o.matchesIgnoreRule(line)
+}
@@ -0,0 +1,135 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// configStore keeps named configuration entries in memory and persists them
+// as a JSON array. Entries are validated and compiled when loaded or saved.
+type configStore[T any] struct {
+	mu       sync.Mutex
+	path     string
+	loaded   bool
+	items    map[string]T
+	name     func(T) string
+	compile  func(*T) error
+	defaults []T // Built-in entries available even when the file is absent.
+}
+
+// load reads the persisted entries on first use. Callers hold s.mu.
+func (s *configStore[T]) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.items = make(map[string]T)
+
+	for _, item := range s.defaults {
+		if err := s.compile(&item); err != nil {
+			return err
+		}
+		s.items[s.name(item)] = item
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var items []T
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	for _, item := range items {
+		if err := s.compile(&item); err != nil {
+			return err
+		}
+		s.items[s.name(item)] = item
+	}
+	s.loaded = true
+	return nil
+}
+
+// save writes all entries to disk. Callers hold s.mu.
+func (s *configStore[T]) save() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0644)
+}
+
+// sorted returns the entries ordered by name. Callers hold s.mu.
+func (s *configStore[T]) sorted() []T {
+	items := make([]T, 0, len(s.items))
+	for _, item := range s.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return s.name(items[i]) < s.name(items[j])
+	})
+	return items
+}
+
+// List returns all entries sorted by name.
+func (s *configStore[T]) List() ([]T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.sorted(), nil
+}
+
+// Get returns the named entry.
+func (s *configStore[T]) Get(name string) (T, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var zero T
+	if err := s.load(); err != nil {
+		return zero, false, err
+	}
+	item, ok := s.items[name]
+	return item, ok, nil
+}
+
+// Put stores an already compiled entry and persists the store.
+func (s *configStore[T]) Put(item T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.items[s.name(item)] = item
+	return s.save()
+}
+
+// Delete removes the named entry and reports whether it existed.
+func (s *configStore[T]) Delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	if _, ok := s.items[name]; !ok {
+		return false, nil
+	}
+	delete(s.items, name)
+	return true, s.save()
+}
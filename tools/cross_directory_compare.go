@@ -0,0 +1,343 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CrossDirectoryResult compares one side of every trade across the
+// directories of an archive, e.g. the baby files of ABC, ABD and ABE.
+type CrossDirectoryResult struct {
+	ArchiveName string                 `json:"archive_name"`
+	Side        string                 `json:"side"`
+	Directories []string               `json:"directories"`
+	Matrix      [][]CrossDirectoryCell `json:"matrix"` // Matrix[i][j] counts trades shared by Directories i and j.
+	Agreeing    int                    `json:"agreeing"`
+	Disagreeing int                    `json:"disagreeing"`
+	Trades      []CrossDirectoryTrade  `json:"trades"`
+	Issues      []TransactionIssue     `json:"issues"`
+}
+
+// CrossDirectoryCell counts the trades on which two directories agree or
+// disagree.
+type CrossDirectoryCell struct {
+	Agree    int `json:"agree"`
+	Disagree int `json:"disagree"`
+}
+
+// CrossDirectoryTrade is the N-way comparison of one trade. Matrix[i][j] is
+// the number of changed lines between Directories i and j; 0 means they agree.
+type CrossDirectoryTrade struct {
+	TransactionID string               `json:"transaction_id"`
+	Directories   []string             `json:"directories"`
+	Files         []string             `json:"files"`
+	Missing       []string             `json:"missing"` // Directories without this side of the trade.
+	Agree         bool                 `json:"agree"`   // Every directory holds the trade and all copies agree.
+	Matrix        [][]int              `json:"matrix"`
+	Differences   []CrossDirectoryDiff `json:"differences"`
+}
+
+// CrossDirectoryDiff is the difference between two disagreeing directories.
+// Summaries carry only the counts; the diff itself is returned by the pair
+// endpoint.
+type CrossDirectoryDiff struct {
+	Left         string          `json:"left"`
+	Right        string          `json:"right"`
+	LeftFile     string          `json:"left_file,omitempty"`
+	RightFile    string          `json:"right_file,omitempty"`
+	ChangedLines int             `json:"changed_lines"`
+	Numeric      *NumericSummary `json:"numeric_summary,omitempty"`
+	DiffLines    []DiffLine      `json:"diff_lines,omitempty"`
+	Hunks        []DiffHunk      `json:"hunks,omitempty"` // Set when the context parameter is given.
+}
+
+// crossDirectoryRequest holds the parameters shared by the cross-directory
+// endpoints.
+type crossDirectoryRequest struct {
+	archive uploadEntry
+	opts    CompareOptions
+	rule    PairingRule
+	side    string
+	timeout time.Duration
+}
+
+// parseCrossDirectoryRequest validates the comparison parameters. On failure
+// it writes the error response and returns false.
+func parseCrossDirectoryRequest(c *gin.Context) (crossDirectoryRequest, bool) {
+	var req crossDirectoryRequest
+	extractID := c.Query("extract_dir")
+
+	if extractID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing extract directory parameter"})
+		return req, false
+	}
+
+	archive, ok := uploads.Resolve(extractID, uploadKindArchive)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "archive not found"})
+		return req, false
+	}
+	req.archive = archive
+
+	var err error
+	if req.opts, err = parseCompareOptions(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+
+	if req.rule, err = lookupPairingRule(c.Query("pairing_rule")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+
+	req.side = c.DefaultQuery("side", req.rule.LeftLabel)
+	if req.side != req.rule.LeftLabel && req.side != req.rule.RightLabel {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid side %q, expected %q or %q", req.side, req.rule.LeftLabel, req.rule.RightLabel)})
+		return req, false
+	}
+
+	if req.timeout, err = parseCompareTimeout(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+
+	return req, true
+}
+
+func HandleCrossDirectoryCompare(c *gin.Context) {
+	req, ok := parseCrossDirectoryRequest(c)
+	if !ok {
+		return
+	}
+
+	_, transactions, err := analyzeExtractedArchive(req.archive.Path, req.rule)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to analyze archive structure: " + err.Error()})
+		return
+	}
+
+	result, err := compareAcrossDirectories(c.Request.Context(), transactions, req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to compare trade files: " + err.Error()})
+		return
+	}
+	result.ArchiveName = req.archive.Name
+
+	c.JSON(http.StatusOK, result)
+}
+
+// HandleCrossDirectoryDiff returns the diff of one side of a trade between
+// the left and right directories, as hunks when context is given.
+func HandleCrossDirectoryDiff(c *gin.Context) {
+	req, ok := parseCrossDirectoryRequest(c)
+	if !ok {
+		return
+	}
+
+	contextLines, hunked, err := parseDiffContext(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transactionID, left, right := c.Query("transaction_id"), c.Query("left"), c.Query("right")
+	if transactionID == "" || left == "" || right == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing transaction_id, left or right parameter"})
+		return
+	}
+
+	_, transactions, err := analyzeExtractedArchive(req.archive.Path, req.rule)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to analyze archive structure: " + err.Error()})
+		return
+	}
+	index := slices.IndexFunc(transactions, func(t TransactionInfo) bool { return t.ID == transactionID })
+	if index < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "trade not found"})
+		return
+	}
+
+	var files [2]transactionSide
+	for i, dir := range []string{left, right} {
+		sides, _ := readTransactionSides(transactions[index], dir, func(TransactionIssue) {})
+		side, ok := sides[req.side]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no readable %s file for trade %s in %s", req.side, transactionID, dir)})
+			return
+		}
+		files[i] = side
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), req.timeout)
+	defer cancel()
+	diffLines, numeric, err := generateLineByLineDiffContext(ctx, strings.Split(files[0].content, "\n"), strings.Split(files[1].content, "\n"), req.opts)
+	if err != nil {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": fmt.Sprintf("comparing the trade took longer than %s", req.timeout)})
+		return
+	}
+
+	diff := CrossDirectoryDiff{
+		Left:         left,
+		Right:        right,
+		LeftFile:     files[0].file.FileName,
+		RightFile:    files[1].file.FileName,
+		ChangedLines: countChangedLines(diffLines),
+		Numeric:      numeric,
+		DiffLines:    diffLines,
+	}
+	if hunked {
+		diff.Hunks = buildDiffHunks(diffLines, contextLines)
+		diff.DiffLines = nil
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// compareAcrossDirectories diffs every pair of directories holding the chosen
+// side of a trade and aggregates pairwise agreement over the archive. The
+// pairs of each trade share the request timeout; a trade that runs out of
+// time is reported as an issue. It stops with the context's error when ctx
+// is cancelled.
+func compareAcrossDirectories(ctx context.Context, transactions []TransactionInfo, req crossDirectoryRequest) (CrossDirectoryResult, error) {
+	side := req.side
+	result := CrossDirectoryResult{
+		Side:        side,
+		Directories: []string{},
+		Trades:      []CrossDirectoryTrade{},
+		Issues:      []TransactionIssue{},
+	}
+
+	// Directories holding any file of this side.
+	seen := make(map[string]bool)
+	for _, transaction := range transactions {
+		for _, file := range transaction.Files {
+			if file.Type == side && !seen[file.Directory] {
+				seen[file.Directory] = true
+				result.Directories = append(result.Directories, file.Directory)
+			}
+		}
+	}
+	sort.Strings(result.Directories)
+
+	position := make(map[string]int, len(result.Directories))
+	result.Matrix = make([][]CrossDirectoryCell, len(result.Directories))
+	for i, dir := range result.Directories {
+		position[dir] = i
+		result.Matrix[i] = make([]CrossDirectoryCell, len(result.Directories))
+	}
+
+	for _, transaction := range transactions {
+		trade := CrossDirectoryTrade{
+			TransactionID: transaction.ID,
+			Directories:   []string{},
+			Files:         []string{},
+			Missing:       []string{},
+			Agree:         true,
+			Differences:   []CrossDirectoryDiff{},
+		}
+
+		var contents []string
+		for _, dir := range result.Directories {
+			sides, _ := readTransactionSides(transaction, dir, func(issue TransactionIssue) {
+				if issue.Side == side {
+					result.Issues = append(result.Issues, issue)
+				}
+			})
+			chosen, ok := sides[side]
+			if !ok {
+				trade.Missing = append(trade.Missing, dir)
+				continue
+			}
+			trade.Directories = append(trade.Directories, dir)
+			trade.Files = append(trade.Files, chosen.file.FileName)
+			contents = append(contents, chosen.content)
+		}
+		if len(trade.Directories) == 0 {
+			continue
+		}
+
+		if err := compareTradeAcrossDirectories(ctx, &trade, contents, req); err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			result.Issues = append(result.Issues, TransactionIssue{
+				TransactionID: transaction.ID,
+				Type:          issueComparisonTimeout,
+				Reason:        fmt.Sprintf("comparing trade %s across directories took longer than %s", transaction.ID, req.timeout),
+			})
+			continue
+		}
+
+		for i := range trade.Directories {
+			for j := i + 1; j < len(trade.Directories); j++ {
+				cell := &result.Matrix[position[trade.Directories[i]]][position[trade.Directories[j]]]
+				mirror := &result.Matrix[position[trade.Directories[j]]][position[trade.Directories[i]]]
+				if trade.Matrix[i][j] == 0 {
+					cell.Agree++
+					mirror.Agree++
+				} else {
+					cell.Disagree++
+					mirror.Disagree++
+				}
+			}
+		}
+
+		trade.Agree = trade.Agree && len(trade.Missing) == 0
+		if trade.Agree {
+			result.Agreeing++
+		} else {
+			result.Disagreeing++
+		}
+		result.Trades = append(result.Trades, trade)
+	}
+
+	return result, nil
+}
+
+// compareTradeAcrossDirectories fills the changed-lines matrix and the
+// differences of a trade from the contents of its directories, giving up
+// with an error once the trade's timeout expires or ctx is done.
+func compareTradeAcrossDirectories(ctx context.Context, trade *CrossDirectoryTrade, contents []string, req crossDirectoryRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, req.timeout)
+	defer cancel()
+
+	lines := make([][]string, len(contents))
+	for i, content := range contents {
+		lines[i] = strings.Split(content, "\n")
+	}
+
+	trade.Matrix = make([][]int, len(trade.Directories))
+	for i := range trade.Matrix {
+		trade.Matrix[i] = make([]int, len(trade.Directories))
+	}
+	for i := range trade.Directories {
+		for j := i + 1; j < len(trade.Directories); j++ {
+			if contents[i] == contents[j] {
+				continue
+			}
+			diffLines, numeric, err := generateLineByLineDiffContext(ctx, lines[i], lines[j], req.opts)
+			if err != nil {
+				return err
+			}
+			changed := countChangedLines(diffLines)
+			if changed > 0 {
+				trade.Differences = append(trade.Differences, CrossDirectoryDiff{
+					Left:         trade.Directories[i],
+					Right:        trade.Directories[j],
+					ChangedLines: changed,
+					Numeric:      numeric,
+				})
+				trade.Agree = false
+			}
+			trade.Matrix[i][j], trade.Matrix[j][i] = changed, changed
+		}
+	}
+	return nil
+}
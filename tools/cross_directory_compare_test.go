@@ -0,0 +1,188 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCrossDirectoryRequest analyses an extracted archive for comparing
+// the baby side across directories.
+func newTestCrossDirectoryRequest(t *testing.T, root string, timeout time.Duration) (crossDirectoryRequest, []TransactionInfo) {
+	t.Helper()
+	req := crossDirectoryRequest{rule: testPairingRule(t), timeout: timeout}
+	req.side = req.rule.LeftLabel
+	_, transactions, err := analyzeExtractedArchive(root, req.rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req, transactions
+}
+
+// writeCrossDirectoryArchive writes four trades over ABC, ABD and ABE: trade
+// 1 agrees everywhere, trade 2 differs in ABE, trade 3 is missing from ABD
+// and trade 4 differs in every directory.
+func writeCrossDirectoryArchive(t *testing.T, root string) {
+	t.Helper()
+	for _, dir := range []string{"ABC", "ABD", "ABE"} {
+		writeTradeFiles(t, root, dir, "1", "PV=1\nDelta=2\n", "PV=0\n")
+		trade2 := "PV=2\nDelta=3\n"
+		if dir == "ABE" {
+			trade2 = "PV=2.5\nDelta=3\n"
+		}
+		writeTradeFiles(t, root, dir, "2", trade2, "PV=0\n")
+		if dir != "ABD" {
+			writeTradeFiles(t, root, dir, "3", "PV=3\n", "PV=0\n")
+		}
+		writeTradeFiles(t, root, dir, "4", "PV=4\nBook="+dir+"\n", "PV=0\n")
+	}
+}
+
+func TestCompareAcrossDirectories(t *testing.T) {
+	root := t.TempDir()
+	writeCrossDirectoryArchive(t, root)
+	req, transactions := newTestCrossDirectoryRequest(t, root, time.Minute)
+
+	result, err := compareAcrossDirectories(context.Background(), transactions, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"ABC", "ABD", "ABE"}; !reflect.DeepEqual(result.Directories, want) {
+		t.Fatalf("directories = %v, want %v", result.Directories, want)
+	}
+	wantMatrix := [][]CrossDirectoryCell{
+		{{}, {Agree: 2, Disagree: 1}, {Agree: 2, Disagree: 2}},
+		{{Agree: 2, Disagree: 1}, {}, {Agree: 1, Disagree: 2}},
+		{{Agree: 2, Disagree: 2}, {Agree: 1, Disagree: 2}, {}},
+	}
+	if !reflect.DeepEqual(result.Matrix, wantMatrix) {
+		t.Errorf("matrix = %v, want %v", result.Matrix, wantMatrix)
+	}
+	if result.Agreeing != 1 || result.Disagreeing != 3 || len(result.Issues) != 0 {
+		t.Errorf("%d agreeing, %d disagreeing and %d issues, want 1, 3 and 0", result.Agreeing, result.Disagreeing, len(result.Issues))
+	}
+
+	trades := make(map[string]CrossDirectoryTrade)
+	for _, trade := range result.Trades {
+		trades[trade.TransactionID] = trade
+	}
+	if trade := trades["1"]; !trade.Agree || len(trade.Differences) != 0 {
+		t.Errorf("trade 1: %+v, want agreement", trade)
+	}
+
+	trade2 := trades["2"]
+	if want := [][]int{{0, 0, 1}, {0, 0, 1}, {1, 1, 0}}; trade2.Agree || !reflect.DeepEqual(trade2.Matrix, want) {
+		t.Errorf("trade 2: agree %v, matrix %v, want false and %v", trade2.Agree, trade2.Matrix, want)
+	}
+	if len(trade2.Differences) != 2 {
+		t.Fatalf("trade 2: %d differences, want 2", len(trade2.Differences))
+	}
+	for _, diff := range trade2.Differences {
+		if diff.Right != "ABE" || diff.ChangedLines != 1 {
+			t.Errorf("trade 2: difference %s vs %s with %d changed lines", diff.Left, diff.Right, diff.ChangedLines)
+		}
+		if diff.DiffLines != nil || diff.Hunks != nil {
+			t.Errorf("trade 2: summary difference carries the diff")
+		}
+	}
+
+	trade3 := trades["3"]
+	if trade3.Agree || !reflect.DeepEqual(trade3.Missing, []string{"ABD"}) || len(trade3.Differences) != 0 {
+		t.Errorf("trade 3: %+v, want disagreement from missing ABD", trade3)
+	}
+	if want := [][]int{{0, 0}, {0, 0}}; !reflect.DeepEqual(trade3.Matrix, want) {
+		t.Errorf("trade 3: matrix %v, want %v", trade3.Matrix, want)
+	}
+
+	if trade4 := trades["4"]; len(trade4.Differences) != 3 {
+		t.Errorf("trade 4: %d differences, want 3", len(trade4.Differences))
+	}
+}
+
+func TestCompareAcrossDirectoriesTimeout(t *testing.T) {
+	root := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	writeTradeFiles(t, root, "ABC", "1", pathologicalLines(rng, 20000), "")
+	writeTradeFiles(t, root, "ABD", "1", pathologicalLines(rng, 20000), "")
+	writeTradeFiles(t, root, "ABC", "2", "PV=1\n", "")
+	writeTradeFiles(t, root, "ABD", "2", "PV=1\n", "")
+	req, transactions := newTestCrossDirectoryRequest(t, root, time.Millisecond)
+
+	start := time.Now()
+	result, err := compareAcrossDirectories(context.Background(), transactions, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timed-out comparison took %s", elapsed)
+	}
+	if len(result.Issues) != 1 || result.Issues[0].Type != issueComparisonTimeout || result.Issues[0].TransactionID != "1" {
+		t.Errorf("issues = %+v, want a timeout of trade 1", result.Issues)
+	}
+	if len(result.Trades) != 1 || result.Agreeing != 1 {
+		t.Errorf("got %d trades with %d agreeing, want trade 2 agreeing", len(result.Trades), result.Agreeing)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req.timeout = time.Minute
+	if _, err := compareAcrossDirectories(ctx, transactions, req); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestHandleCrossDirectoryDiff(t *testing.T) {
+	root := filepath.Join(useTestUploads(t), "archive")
+	writeCrossDirectoryArchive(t, root)
+	id, err := uploads.Register(uploadKindArchive, root, "release.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "/api/archive-compare/cross-directory/diff?extract_dir=" + id
+
+	w := serveTestRequest(HandleCrossDirectoryDiff, query+"&transaction_id=2&left=ABC&right=ABE")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var diff CrossDirectoryDiff
+	if err := json.Unmarshal(w.Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := generateLineByLineDiff(strings.Split("PV=2\nDelta=3\n", "\n"), strings.Split("PV=2.5\nDelta=3\n", "\n"), CompareOptions{})
+	if diff.ChangedLines != 1 || diff.LeftFile != "babyy-risk-2.txt" || !reflect.DeepEqual(diff.DiffLines, want) {
+		t.Errorf("diff = %+v, want the ABC and ABE baby files of trade 2", diff)
+	}
+
+	w = serveTestRequest(HandleCrossDirectoryDiff, query+"&transaction_id=2&left=ABC&right=ABE&context=0")
+	diff = CrossDirectoryDiff{}
+	if err := json.Unmarshal(w.Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.DiffLines != nil || len(diff.Hunks) != 2 || diff.Hunks[0].Header != "@@ -1 +1 @@" {
+		t.Errorf("hunked diff = %+v, want one hunk and a collapsed run", diff)
+	}
+
+	for _, tt := range []struct {
+		params string
+		status int
+	}{
+		{"&transaction_id=9&left=ABC&right=ABE", http.StatusNotFound},
+		{"&transaction_id=3&left=ABC&right=ABD", http.StatusNotFound},
+		{"&transaction_id=2&left=ABC", http.StatusBadRequest},
+		{"&transaction_id=2&left=ABC&right=ABE&side=other", http.StatusBadRequest},
+	} {
+		if w := serveTestRequest(HandleCrossDirectoryDiff, query+tt.params); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.params, w.Code, tt.status)
+		}
+	}
+	if w := serveTestRequest(HandleCrossDirectoryDiff, query+"&transaction_id=2&left=ABC&right=ABE&timeout=0s"); w.Code != http.StatusBadRequest {
+		t.Errorf("zero timeout: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,542 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// csvCompareDefaultLimit caps the rows listed per category; counts are
+// always exact.
+const csvCompareDefaultLimit = 1000
+
+type CSVCompareResult struct {
+	LeftName           string            `json:"left_name"`
+	RightName          string            `json:"right_name"`
+	KeyColumns         []string          `json:"key_columns"`
+	ComparedColumns    []string          `json:"compared_columns"`
+	IgnoredColumns     []string          `json:"ignored_columns"`
+	OnlyInLeftColumns  []string          `json:"only_in_left_columns"`
+	OnlyInRightColumns []string          `json:"only_in_right_columns"`
+	ColumnTypes        map[string]string `json:"column_types"`
+	LeftRows           int               `json:"left_rows"`
+	RightRows          int               `json:"right_rows"`
+	IdenticalRows      int               `json:"identical_rows"`
+	ChangedRows        int               `json:"changed_rows"`
+	AddedRows          int               `json:"added_rows"`   // Keys only in the right file.
+	RemovedRows        int               `json:"removed_rows"` // Keys only in the left file.
+	ColumnChanges      map[string]int    `json:"column_changes"`
+	Added              []CSVKeyedRow     `json:"added"`
+	Removed            []CSVKeyedRow     `json:"removed"`
+	Changed            []CSVRowChange    `json:"changed"`
+	DuplicateKeys      []CSVDuplicateKey `json:"duplicate_keys"`
+	Truncated          bool              `json:"truncated"` // Some rows were counted but not listed.
+	Warnings           []CSVWarning      `json:"warnings,omitempty"`
+}
+
+// CSVKeyedRow is a row present in only one of the files.
+type CSVKeyedRow struct {
+	Key    []string `json:"key"`
+	Row    int      `json:"row"` // One-based data row number.
+	Values []string `json:"values"`
+}
+
+// CSVRowChange lists the differing columns of a row present in both files.
+type CSVRowChange struct {
+	Key         []string            `json:"key"`
+	LeftRow     int                 `json:"left_row"`
+	RightRow    int                 `json:"right_row"`
+	Differences []CSVCellDifference `json:"differences"`
+}
+
+type CSVCellDifference struct {
+	Column  string   `json:"column"`
+	Left    string   `json:"left"`
+	Right   string   `json:"right"`
+	AbsDiff *float64 `json:"abs_diff,omitempty"` // Set for numeric values.
+	RelDiff *float64 `json:"rel_diff,omitempty"`
+}
+
+// CSVDuplicateKey reports a key repeated within one file. Only the first
+// occurrence takes part in the comparison.
+type CSVDuplicateKey struct {
+	Side string   `json:"side"` // "left" or "right".
+	Key  []string `json:"key"`
+	Rows []int    `json:"rows"`
+}
+
+// csvTolerance is the numeric tolerance of one column. A value differs only
+// when it exceeds both the absolute and the relative tolerance.
+type csvTolerance struct {
+	abs, rel float64
+}
+
+// csvCompareColumn is a non-key column present in both files.
+type csvCompareColumn struct {
+	name        string
+	left, right int
+	columnType  string
+	tolerance   *csvTolerance
+}
+
+// csvComparePlan holds the resolved key and compared columns.
+type csvComparePlan struct {
+	leftKeys  []int
+	rightKeys []int
+	columns   []*csvCompareColumn
+}
+
+// csvKeyedRow is a row of the left file held in memory by key.
+type csvKeyedRow struct {
+	row     int
+	values  []string
+	matched bool
+}
+
+func HandleCSVCompareUpload(c *gin.Context) {
+	ids := make(map[string]string)
+	dialects := make(map[string]CSVDialect)
+
+	if _, err := applyCSVDialectOverrides(c, CSVDialect{}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, side := range []string{"left", "right"} {
+		// Retrieve uploaded file.
+		file, err := c.FormFile(side)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to retrieve " + side + " file"})
+			return
+		}
+		if filepath.Ext(file.Filename) != ".csv" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "please upload a CSV file for " + side})
+			return
+		}
+
+		id, dialect, err := storeCSVUpload(c, file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ids[side] = id
+		dialects[side] = dialect
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "CSV files uploaded successfully",
+		"left":          ids["left"],
+		"right":         ids["right"],
+		"left_dialect":  dialects["left"],
+		"right_dialect": dialects["right"],
+	})
+}
+
+func HandleCSVCompare(c *gin.Context) {
+	leftID := c.Query("left")
+	rightID := c.Query("right")
+	keys := c.QueryArray("key")
+
+	if leftID == "" || rightID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing left or right parameter"})
+		return
+	}
+	if len(keys) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one key column is required"})
+		return
+	}
+
+	left, ok1 := uploads.Resolve(leftID, uploadKindCSV)
+	right, ok2 := uploads.Resolve(rightID, uploadKindCSV)
+	if !ok1 || !ok2 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	tolerances, err := parseCSVTolerances(c.QueryArray("tolerance"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := csvCompareDefaultLimit
+	if raw := c.Query("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 0 || limit > csvMaxLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid limit %q, expected 0 to %d", raw, csvMaxLimit)})
+			return
+		}
+	}
+
+	leftSource, err := openCSVUpload(left)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read left file: " + err.Error()})
+		return
+	}
+	defer leftSource.Close()
+
+	rightSource, err := openCSVUpload(right)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read right file: " + err.Error()})
+		return
+	}
+	defer rightSource.Close()
+
+	result := &CSVCompareResult{
+		LeftName:           left.Name,
+		RightName:          right.Name,
+		KeyColumns:         keys,
+		ComparedColumns:    []string{},
+		IgnoredColumns:     c.QueryArray("ignore"),
+		OnlyInLeftColumns:  []string{},
+		OnlyInRightColumns: []string{},
+		ColumnTypes:        make(map[string]string),
+		ColumnChanges:      make(map[string]int),
+		Added:              []CSVKeyedRow{},
+		Removed:            []CSVKeyedRow{},
+		Changed:            []CSVRowChange{},
+		DuplicateKeys:      []CSVDuplicateKey{},
+	}
+	if result.IgnoredColumns == nil {
+		result.IgnoredColumns = []string{}
+	}
+
+	plan, err := planCSVCompare(leftSource.Headers, rightSource.Headers, tolerances, result)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := compareKeyedCSV(leftSource, rightSource, plan, limit, result); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// openCSVUpload opens an uploaded CSV file with its recorded dialect.
+func openCSVUpload(upload uploadEntry) (*csvSource, error) {
+	dialect, err := loadCSVDialect(upload.Path)
+	if err != nil {
+		return nil, err
+	}
+	return openCSVSource(upload.Path, dialect)
+}
+
+// parseCSVTolerances parses tolerance expressions of the form
+// "column:abs" or "column:abs:rel".
+func parseCSVTolerances(expressions []string) (map[string]csvTolerance, error) {
+	tolerances := make(map[string]csvTolerance)
+
+	for _, expression := range expressions {
+		parts := strings.SplitN(expression, ":", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid tolerance %q, expected column:abs[:rel]", expression)
+		}
+
+		var tolerance csvTolerance
+		var err error
+		if tolerance.abs, err = strconv.ParseFloat(parts[1], 64); err != nil || tolerance.abs < 0 {
+			return nil, fmt.Errorf("invalid absolute tolerance in %q", expression)
+		}
+		if len(parts) == 3 {
+			if tolerance.rel, err = strconv.ParseFloat(parts[2], 64); err != nil || tolerance.rel < 0 {
+				return nil, fmt.Errorf("invalid relative tolerance in %q", expression)
+			}
+		}
+		tolerances[parts[0]] = tolerance
+	}
+
+	return tolerances, nil
+}
+
+// planCSVCompare resolves the key columns of both files and the columns to
+// compare, recording the column layout in the result.
+func planCSVCompare(leftHeaders, rightHeaders []string, tolerances map[string]csvTolerance, result *CSVCompareResult) (*csvComparePlan, error) {
+	plan := &csvComparePlan{}
+	var err error
+	if plan.leftKeys, err = csvKeyColumns(leftHeaders, result.KeyColumns, "left"); err != nil {
+		return nil, err
+	}
+	if plan.rightKeys, err = csvKeyColumns(rightHeaders, result.KeyColumns, "right"); err != nil {
+		return nil, err
+	}
+
+	// Columns may be given by name or index, so they are resolved to header
+	// names before being excluded.
+	ignored := make(map[string]bool)
+	ignoredNames := make([]string, len(result.IgnoredColumns))
+	for i, column := range result.IgnoredColumns {
+		name, err := csvColumnName(leftHeaders, rightHeaders, column)
+		if err != nil {
+			return nil, fmt.Errorf("ignored column: %v", err)
+		}
+		ignoredNames[i] = name
+		ignored[name] = true
+	}
+	keyNames := make([]string, len(result.KeyColumns))
+	for i := range result.KeyColumns {
+		keyNames[i] = leftHeaders[plan.leftKeys[i]]
+		ignored[leftHeaders[plan.leftKeys[i]]] = true
+		ignored[rightHeaders[plan.rightKeys[i]]] = true
+	}
+	result.KeyColumns, result.IgnoredColumns = keyNames, ignoredNames
+
+	// Columns are matched by header name.
+	rightIndex := make(map[string]int)
+	for i, name := range rightHeaders {
+		rightIndex[name] = i
+	}
+	leftNames := make(map[string]bool)
+	for i, name := range leftHeaders {
+		leftNames[name] = true
+		j, ok := rightIndex[name]
+		if !ok {
+			result.OnlyInLeftColumns = append(result.OnlyInLeftColumns, name)
+			continue
+		}
+		if ignored[name] {
+			continue
+		}
+		column := &csvCompareColumn{name: name, left: i, right: j}
+		if tolerance, ok := tolerances[name]; ok {
+			column.tolerance = &tolerance
+		}
+		plan.columns = append(plan.columns, column)
+		result.ComparedColumns = append(result.ComparedColumns, name)
+	}
+	for _, name := range rightHeaders {
+		if !leftNames[name] {
+			result.OnlyInRightColumns = append(result.OnlyInRightColumns, name)
+		}
+	}
+	for name := range tolerances {
+		found := false
+		for _, column := range plan.columns {
+			found = found || column.name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("tolerance for column %q, which is not compared", name)
+		}
+	}
+
+	return plan, nil
+}
+
+// csvColumnName resolves a column reference to a header name, looking in the
+// left file first and then in the right one.
+func csvColumnName(leftHeaders, rightHeaders []string, column string) (string, error) {
+	if index, err := csvColumnIndex(leftHeaders, column); err == nil {
+		return leftHeaders[index], nil
+	}
+	index, err := csvColumnIndex(rightHeaders, column)
+	if err != nil {
+		return "", err
+	}
+	return rightHeaders[index], nil
+}
+
+// compareKeyedCSV matches the rows of two CSV files by key. The left file is
+// held in memory by key and the right file is streamed against it.
+func compareKeyedCSV(left, right *csvSource, plan *csvComparePlan, limit int, result *CSVCompareResult) error {
+	leftKeys, rightKeys, columns := plan.leftKeys, plan.rightKeys, plan.columns
+
+	// Load the left file by key.
+	leftRows := make(map[string]*csvKeyedRow)
+	var leftOrder []string
+	var sample [][]string
+	duplicates := make(map[string]*CSVDuplicateKey)
+	for {
+		record, err := left.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read left file: %v", err)
+		}
+		result.LeftRows++
+
+		key := csvRowKey(record, leftKeys)
+		if first, ok := leftRows[key]; ok {
+			recordDuplicateKey(duplicates, "left", record, leftKeys, first.row, left.row)
+			continue
+		}
+		leftRows[key] = &csvKeyedRow{row: left.row, values: record}
+		leftOrder = append(leftOrder, key)
+		if len(sample) < csvTypeSampleRows {
+			sample = append(sample, record)
+		}
+	}
+
+	// Column types come from the left file and decide numeric comparison.
+	for _, column := range columns {
+		column.columnType = analyzeColumnType(sample, column.left)
+		result.ColumnTypes[column.name] = column.columnType
+	}
+
+	// Stream the right file against the left rows.
+	rightSeen := make(map[string]int)
+	for {
+		record, err := right.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read right file: %v", err)
+		}
+		result.RightRows++
+
+		key := csvRowKey(record, rightKeys)
+		if first, ok := rightSeen[key]; ok {
+			recordDuplicateKey(duplicates, "right", record, rightKeys, first, right.row)
+			continue
+		}
+		rightSeen[key] = right.row
+
+		leftRow, ok := leftRows[key]
+		if !ok {
+			result.AddedRows++
+			if len(result.Added) < limit {
+				result.Added = append(result.Added, CSVKeyedRow{Key: csvKeyValues(record, rightKeys), Row: right.row, Values: record})
+			}
+			continue
+		}
+		leftRow.matched = true
+
+		var differences []CSVCellDifference
+		for _, column := range columns {
+			if difference, ok := compareCSVCells(csvCell(leftRow.values, column.left), csvCell(record, column.right), column); !ok {
+				differences = append(differences, difference)
+				result.ColumnChanges[column.name]++
+			}
+		}
+		if len(differences) == 0 {
+			result.IdenticalRows++
+			continue
+		}
+		result.ChangedRows++
+		if len(result.Changed) < limit {
+			result.Changed = append(result.Changed, CSVRowChange{
+				Key:         csvKeyValues(record, rightKeys),
+				LeftRow:     leftRow.row,
+				RightRow:    right.row,
+				Differences: differences,
+			})
+		}
+	}
+
+	for _, key := range leftOrder {
+		leftRow := leftRows[key]
+		if leftRow.matched {
+			continue
+		}
+		result.RemovedRows++
+		if len(result.Removed) < limit {
+			result.Removed = append(result.Removed, CSVKeyedRow{Key: csvKeyValues(leftRow.values, leftKeys), Row: leftRow.row, Values: leftRow.values})
+		}
+	}
+
+	for _, duplicate := range duplicates {
+		result.DuplicateKeys = append(result.DuplicateKeys, *duplicate)
+	}
+	sortCSVDuplicateKeys(result.DuplicateKeys)
+
+	result.Truncated = result.AddedRows > len(result.Added) ||
+		result.RemovedRows > len(result.Removed) ||
+		result.ChangedRows > len(result.Changed)
+	result.Warnings = append(csvSideWarnings(left.Warnings, "left"), csvSideWarnings(right.Warnings, "right")...)
+	return nil
+}
+
+// csvKeyColumns resolves the key columns of one file.
+func csvKeyColumns(headers, keys []string, side string) ([]int, error) {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		index, err := csvColumnIndex(headers, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s file: %v", side, err)
+		}
+		indexes[i] = index
+	}
+	return indexes, nil
+}
+
+// csvSideWarnings returns copies of warnings marked with the file they came
+// from.
+func csvSideWarnings(warnings []CSVWarning, side string) []CSVWarning {
+	marked := make([]CSVWarning, len(warnings))
+	for i, warning := range warnings {
+		warning.Side = side
+		marked[i] = warning
+	}
+	return marked
+}
+
+func csvKeyValues(record []string, keys []int) []string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = csvCell(record, key)
+	}
+	return values
+}
+
+// csvRowKey joins the key values with a separator that cannot occur in text.
+func csvRowKey(record []string, keys []int) string {
+	return strings.Join(csvKeyValues(record, keys), "\x00")
+}
+
+func recordDuplicateKey(duplicates map[string]*CSVDuplicateKey, side string, record []string, keys []int, firstRow, row int) {
+	id := side + "\x00" + csvRowKey(record, keys)
+	duplicate, ok := duplicates[id]
+	if !ok {
+		duplicate = &CSVDuplicateKey{Side: side, Key: csvKeyValues(record, keys), Rows: []int{firstRow}}
+		duplicates[id] = duplicate
+	}
+	duplicate.Rows = append(duplicate.Rows, row)
+}
+
+func sortCSVDuplicateKeys(duplicates []CSVDuplicateKey) {
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].Side != duplicates[j].Side {
+			return duplicates[i].Side < duplicates[j].Side
+		}
+		return duplicates[i].Rows[0] < duplicates[j].Rows[0]
+	})
+}
+
+// compareCSVCells compares two cells of a column. Numeric columns and columns
+// with a tolerance compare by value; everything else, including NaN and
+// infinities, which parseCSVNumber rejects, compares as text.
+func compareCSVCells(left, right string, column *csvCompareColumn) (CSVCellDifference, bool) {
+	difference := CSVCellDifference{Column: column.name, Left: left, Right: right}
+	if left == right {
+		return difference, true
+	}
+
+	if isNumericColumnType(column.columnType) || column.tolerance != nil {
+		x, okLeft := parseCSVNumber(left)
+		y, okRight := parseCSVNumber(right)
+		if okLeft && okRight {
+			absDiff := math.Abs(x - y)
+			relDiff := 0.0
+			if scale := math.Max(math.Abs(x), math.Abs(y)); scale > 0 {
+				relDiff = absDiff / scale
+			}
+			difference.AbsDiff, difference.RelDiff = &absDiff, &relDiff
+
+			tolerance := csvTolerance{}
+			if column.tolerance != nil {
+				tolerance = *column.tolerance
+			}
+			return difference, absDiff <= tolerance.abs || relDiff <= tolerance.rel
+		}
+	}
+
+	return difference, false
+}
@@ -0,0 +1,127 @@
+package tools
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestCompareCSVCells(t *testing.T) {
+	tolerant := &csvCompareColumn{name: "pv", columnType: "float", tolerance: &csvTolerance{abs: 0.01}}
+	exact := &csvCompareColumn{name: "pv", columnType: "float"}
+	tests := []struct {
+		left, right string
+		column      *csvCompareColumn
+		equal       bool
+		numeric     bool
+	}{
+		{"1.000", "1.005", tolerant, true, true},
+		{"1", "2", tolerant, false, true},
+		{"1,000", "1000", exact, true, true},
+		{"NaN", "1", tolerant, false, false},
+		{"1", "NaN", tolerant, false, false},
+		{"NaN", "NaN", tolerant, true, false},
+		{"Inf", "1", tolerant, false, false},
+		{"Inf", "-Inf", exact, false, false},
+	}
+	for _, tt := range tests {
+		difference, equal := compareCSVCells(tt.left, tt.right, tt.column)
+		if equal != tt.equal {
+			t.Errorf("%s vs %s: equal = %v, want %v", tt.left, tt.right, equal, tt.equal)
+		}
+		if (difference.AbsDiff != nil) != tt.numeric {
+			t.Errorf("%s vs %s: numeric differences set = %v, want %v", tt.left, tt.right, difference.AbsDiff != nil, tt.numeric)
+		}
+		if _, err := json.Marshal(difference); err != nil {
+			t.Errorf("%s vs %s: difference cannot be encoded: %v", tt.left, tt.right, err)
+		}
+	}
+}
+
+func TestPlanCSVCompare(t *testing.T) {
+	left := []string{"trade_id", "book", "pv", "ts", "desk"}
+	right := []string{"trade_id", "book", "pv", "ts", "owner"}
+	tests := []struct {
+		name     string
+		keys     []string
+		ignored  []string
+		keyNames []string
+		ignore   []string
+		compared []string
+	}{
+		{"by name", []string{"trade_id"}, []string{"ts"}, []string{"trade_id"}, []string{"ts"}, []string{"book", "pv"}},
+		{"by index", []string{"0"}, []string{"3"}, []string{"trade_id"}, []string{"ts"}, []string{"book", "pv"}},
+		{"compound key by index", []string{"0", "book"}, nil, []string{"trade_id", "book"}, []string{}, []string{"pv", "ts"}},
+		{"column of one file", []string{"trade_id"}, []string{"owner", "desk"}, []string{"trade_id"}, []string{"owner", "desk"}, []string{"book", "pv", "ts"}},
+	}
+	for _, tt := range tests {
+		result := &CSVCompareResult{KeyColumns: tt.keys, IgnoredColumns: tt.ignored}
+		plan, err := planCSVCompare(left, right, nil, result)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(result.KeyColumns, tt.keyNames) {
+			t.Errorf("%s: key columns = %q, want %q", tt.name, result.KeyColumns, tt.keyNames)
+		}
+		if !reflect.DeepEqual(result.IgnoredColumns, tt.ignore) {
+			t.Errorf("%s: ignored columns = %q, want %q", tt.name, result.IgnoredColumns, tt.ignore)
+		}
+		if !reflect.DeepEqual(result.ComparedColumns, tt.compared) || len(plan.columns) != len(tt.compared) {
+			t.Errorf("%s: compared columns = %q, want %q", tt.name, result.ComparedColumns, tt.compared)
+		}
+	}
+
+	for _, tt := range []struct {
+		keys, ignored []string
+		tolerances    map[string]csvTolerance
+	}{
+		{[]string{"id"}, nil, nil},
+		{[]string{"5"}, nil, nil},
+		{[]string{"trade_id"}, []string{"9"}, nil},
+		{[]string{"trade_id"}, []string{"missing"}, nil},
+		{[]string{"trade_id"}, []string{"pv"}, map[string]csvTolerance{"pv": {abs: 1}}},
+	} {
+		result := &CSVCompareResult{KeyColumns: tt.keys, IgnoredColumns: tt.ignored}
+		if _, err := planCSVCompare(left, right, tt.tolerances, result); err == nil {
+			t.Errorf("key %q, ignored %q: no error", tt.keys, tt.ignored)
+		}
+	}
+}
+
+func TestHandleCSVCompare(t *testing.T) {
+	useTestUploads(t)
+	left := registerTestUpload(t, uploadKindCSV, "left.csv", "id,pv,ts\n1,1.0,a\n2,2.0\n3,3.0,c\n")
+	right := registerTestUpload(t, uploadKindCSV, "right.csv", "id,pv,ts\n1,1.0,x\n2,2.5,b,extra\n4,4.0,d\n")
+
+	w := serveTestRequest(HandleCSVCompare, "/api/csv-compare/compare?left="+left+"&right="+right+"&key=0&ignore=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var result CSVCompareResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.KeyColumns, []string{"id"}) || !reflect.DeepEqual(result.IgnoredColumns, []string{"ts"}) {
+		t.Errorf("key columns %q and ignored columns %q, want id and ts", result.KeyColumns, result.IgnoredColumns)
+	}
+	if !reflect.DeepEqual(result.ComparedColumns, []string{"pv"}) {
+		t.Errorf("compared columns = %q, want pv", result.ComparedColumns)
+	}
+	if result.IdenticalRows != 1 || result.ChangedRows != 1 || result.AddedRows != 1 || result.RemovedRows != 1 {
+		t.Errorf("%d identical, %d changed, %d added and %d removed rows, want 1 of each",
+			result.IdenticalRows, result.ChangedRows, result.AddedRows, result.RemovedRows)
+	}
+	want := []CSVWarning{
+		{Row: 2, Message: "expected 3 fields, got 2", Side: "left"},
+		{Row: 2, Message: "expected 3 fields, got 4", Side: "right"},
+	}
+	if !reflect.DeepEqual(result.Warnings, want) {
+		t.Errorf("warnings = %+v, want %+v", result.Warnings, want)
+	}
+
+	if w := serveTestRequest(HandleCSVCompare, "/api/csv-compare/compare?left="+left+"&right="+right+"&key=id&ignore=7"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown ignored column: status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,556 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Supported CSV text encodings.
+const (
+	csvEncodingUTF8    = "utf-8"
+	csvEncodingUTF16LE = "utf-16le"
+	csvEncodingUTF16BE = "utf-16be"
+	csvEncodingGBK     = "gbk"
+)
+
+const (
+	// csvSniffBytes is the size of the sample used to detect the dialect.
+	csvSniffBytes = 64 << 10
+	// csvSniffRecords is the number of records inspected in the sample.
+	csvSniffRecords = 50
+	// csvMaxWarnings caps the row warnings returned in one response.
+	csvMaxWarnings = 100
+
+	csvDialectSuffix = ".dialect.json"
+)
+
+// csvDelimiterCandidates are the delimiters considered when sniffing.
+var csvDelimiterCandidates = []byte{',', ';', '\t', '|'}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// CSVDialect describes how a CSV file is encoded and delimited.
+type CSVDialect struct {
+	Delimiter string `json:"delimiter"`
+	Quote     string `json:"quote"` // Either " or '.
+	HasHeader bool   `json:"has_header"`
+	Encoding  string `json:"encoding"`
+	BOM       bool   `json:"bom"`
+}
+
+// CSVWarning reports a data row that could not be read cleanly.
+type CSVWarning struct {
+	Row     int    `json:"row"` // One-based data row number.
+	Message string `json:"message"`
+	Side    string `json:"side,omitempty"` // "left" or "right" in comparisons.
+}
+
+// csvSource reads the data rows of a CSV file in a given dialect. Ragged
+// rows are returned with a warning and unparseable rows are skipped with a
+// warning instead of failing the whole file.
+type csvSource struct {
+	file    *os.File
+	reader  *csv.Reader
+	dialect CSVDialect
+	base    int64 // File offset the reader started at.
+	row     int   // Data rows read so far.
+	pending []string
+
+	Headers      []string
+	Warnings     []CSVWarning
+	WarningCount int
+}
+
+// openCSVSource opens a CSV file and reads its header. Files without a
+// header row get generated column names and keep their first row as data.
+func openCSVSource(path string, dialect CSVDialect) (*csvSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &csvSource{file: file, dialect: dialect}
+	if err := s.seek(0, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	first, err := s.next()
+	if err == io.EOF {
+		return s, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if dialect.HasHeader {
+		s.Headers = first
+	} else {
+		s.Headers = make([]string, len(first))
+		for i := range first {
+			s.Headers[i] = fmt.Sprintf("column_%d", i+1)
+		}
+		s.pending = first
+	}
+	s.row = 0
+	return s, nil
+}
+
+func (s *csvSource) Close() error {
+	return s.file.Close()
+}
+
+// seek positions the reader at a byte offset past the header, where row is
+// the number of data rows before that offset. Offset 0 means the start of
+// the file after any byte order mark.
+func (s *csvSource) seek(offset int64, row int) error {
+	if offset == 0 && s.dialect.BOM && s.dialect.Encoding == csvEncodingUTF8 {
+		offset = int64(len(utf8BOM))
+	}
+	if _, err := s.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	s.reader = newCSVReader(s.file, s.dialect)
+	s.base = offset
+	s.row = row
+	s.pending = nil
+	return nil
+}
+
+// offset returns the file offset of the next record. It is only meaningful
+// for UTF-8 files, where decoded and file offsets agree.
+func (s *csvSource) offset() int64 {
+	return s.base + s.reader.InputOffset()
+}
+
+// next reads the next parseable record, recording a warning for each record
+// that is skipped.
+func (s *csvSource) next() ([]string, error) {
+	for {
+		record, err := s.reader.Read()
+		s.row++
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			s.warn(parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.dialect.Quote == "'" {
+			for i, field := range record {
+				record[i] = swapQuotes(field)
+			}
+		}
+		return record, nil
+	}
+}
+
+// Read returns the next data row.
+func (s *csvSource) Read() ([]string, error) {
+	if s.pending != nil {
+		record := s.pending
+		s.pending = nil
+		s.row++
+		s.checkWidth(record)
+		return record, nil
+	}
+
+	record, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	s.checkWidth(record)
+	return record, nil
+}
+
+func (s *csvSource) checkWidth(record []string) {
+	if len(s.Headers) > 0 && len(record) != len(s.Headers) {
+		s.warn(fmt.Sprintf("expected %d fields, got %d", len(s.Headers), len(record)))
+	}
+}
+
+func (s *csvSource) warn(message string) {
+	s.WarningCount++
+	if len(s.Warnings) < csvMaxWarnings {
+		s.Warnings = append(s.Warnings, CSVWarning{Row: s.row, Message: message})
+	}
+}
+
+// newCSVReader returns a lenient CSV reader for the dialect.
+func newCSVReader(r io.Reader, dialect CSVDialect) *csv.Reader {
+	r = csvDecoder(r, dialect.Encoding)
+	if dialect.Quote == "'" {
+		// encoding/csv only understands double quotes, so single and double
+		// quotes are swapped on the way in and back again in each field.
+		r = quoteSwapReader{r: r}
+	}
+
+	reader := csv.NewReader(r)
+	reader.Comma, _ = utf8.DecodeRuneInString(dialect.Delimiter)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+// csvDecoder converts the input to UTF-8.
+func csvDecoder(r io.Reader, encoding string) io.Reader {
+	switch encoding {
+	case csvEncodingUTF16LE:
+		return transform.NewReader(r, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder())
+	case csvEncodingUTF16BE:
+		return transform.NewReader(r, unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewDecoder())
+	case csvEncodingGBK:
+		return transform.NewReader(r, simplifiedchinese.GBK.NewDecoder())
+	}
+	return r
+}
+
+// quoteSwapReader exchanges single and double quotes. Both are ASCII, so
+// multi-byte UTF-8 sequences are never touched.
+type quoteSwapReader struct {
+	r io.Reader
+}
+
+func (q quoteSwapReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case '"':
+			p[i] = '\''
+		case '\'':
+			p[i] = '"'
+		}
+	}
+	return n, err
+}
+
+func swapQuotes(field string) string {
+	if !strings.ContainsAny(field, `"'`) {
+		return field
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '"':
+			return '\''
+		case '\'':
+			return '"'
+		}
+		return r
+	}, field)
+}
+
+// sniffCSVDialect detects the encoding, delimiter, quote character and
+// header presence from the start of a file.
+func sniffCSVDialect(path string) (CSVDialect, error) {
+	dialect := CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return dialect, err
+	}
+	defer file.Close()
+
+	sample := make([]byte, csvSniffBytes)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return dialect, err
+	}
+	sample = sample[:n]
+	truncated := n == csvSniffBytes
+
+	dialect.Encoding, dialect.BOM = sniffCSVEncoding(sample, truncated)
+	if dialect.Encoding == csvEncodingUTF8 && dialect.BOM {
+		sample = sample[len(utf8BOM):]
+	}
+
+	decoded, err := io.ReadAll(csvDecoder(bytes.NewReader(sample), dialect.Encoding))
+	if err != nil {
+		return dialect, err
+	}
+	text := string(decoded)
+	if truncated {
+		// Drop the partial last line.
+		if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+			text = text[:i+1]
+		}
+	}
+
+	dialect.Quote = sniffCSVQuote(text)
+	dialect.Delimiter = sniffCSVDelimiter(text, dialect.Quote[0])
+
+	reader := newCSVReader(strings.NewReader(text), CSVDialect{
+		Delimiter: dialect.Delimiter,
+		Quote:     dialect.Quote,
+		Encoding:  csvEncodingUTF8,
+	})
+	var records [][]string
+	for len(records) < csvSniffRecords {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	dialect.HasHeader = sniffCSVHeader(records)
+
+	return dialect, nil
+}
+
+// sniffCSVEncoding detects the text encoding from a byte order mark, the
+// zero bytes of BOM-less UTF-16 or UTF-8 validity, falling back to GBK.
+func sniffCSVEncoding(sample []byte, truncated bool) (string, bool) {
+	switch {
+	case bytes.HasPrefix(sample, utf8BOM):
+		return csvEncodingUTF8, true
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return csvEncodingUTF16LE, true
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return csvEncodingUTF16BE, true
+	}
+
+	evenZeros, oddZeros := 0, 0
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	if oddZeros > len(sample)/4 && evenZeros == 0 {
+		return csvEncodingUTF16LE, false
+	}
+	if evenZeros > len(sample)/4 && oddZeros == 0 {
+		return csvEncodingUTF16BE, false
+	}
+
+	if truncated {
+		// The sample may end in the middle of a multi-byte character.
+		for i := 0; i < utf8.UTFMax-1 && len(sample) > 0 && !utf8.Valid(sample); i++ {
+			sample = sample[:len(sample)-1]
+		}
+	}
+	if utf8.Valid(sample) {
+		return csvEncodingUTF8, false
+	}
+	return csvEncodingGBK, false
+}
+
+// sniffCSVQuote picks the quote character that opens the most fields.
+func sniffCSVQuote(text string) string {
+	counts := make(map[byte]int)
+	for i := 0; i < len(text); i++ {
+		if text[i] != '"' && text[i] != '\'' {
+			continue
+		}
+		if i == 0 || strings.IndexByte(",;\t|\n", text[i-1]) >= 0 {
+			counts[text[i]]++
+		}
+	}
+	if counts['\''] > counts['"'] {
+		return "'"
+	}
+	return `"`
+}
+
+// sniffCSVDelimiter picks the candidate delimiter that occurs the same
+// number of times, outside quotes, on the most records.
+func sniffCSVDelimiter(text string, quote byte) string {
+	best, bestScore, bestCount := ",", 0.0, 0
+
+	for _, delimiter := range csvDelimiterCandidates {
+		counts := countCSVDelimiters(text, delimiter, quote)
+		if len(counts) == 0 {
+			continue
+		}
+
+		frequency := make(map[int]int)
+		mode := 0
+		for _, count := range counts {
+			frequency[count]++
+			if frequency[count] > frequency[mode] || frequency[count] == frequency[mode] && count > mode {
+				mode = count
+			}
+		}
+		if mode == 0 {
+			continue
+		}
+
+		score := float64(frequency[mode]) / float64(len(counts))
+		if score > bestScore || score == bestScore && mode > bestCount {
+			best, bestScore, bestCount = string(delimiter), score, mode
+		}
+	}
+
+	return best
+}
+
+// countCSVDelimiters counts the delimiters outside quotes on each record.
+func countCSVDelimiters(text string, delimiter, quote byte) []int {
+	var counts []int
+	count, quoted := 0, false
+
+	for i := 0; i < len(text) && len(counts) < csvSniffRecords; i++ {
+		switch c := text[i]; {
+		case c == quote:
+			quoted = !quoted
+		case quoted:
+		case c == delimiter:
+			count++
+		case c == '\n':
+			counts = append(counts, count)
+			count = 0
+		}
+	}
+	if count > 0 {
+		counts = append(counts, count)
+	}
+	return counts
+}
+
+// sniffCSVHeader guesses whether the first record is a header: a first value
+// that does not fit the type of the rest of its column votes for a header,
+// one that fits votes against. Without evidence a header is assumed.
+func sniffCSVHeader(records [][]string) bool {
+	if len(records) < 2 {
+		return true
+	}
+
+	votes := 0
+	for column, value := range records[0] {
+		columnType := analyzeColumnType(records[1:], column)
+		switch columnType {
+		case "empty", "unknown":
+			continue
+		case "string":
+			// Fixed-width codes: a header of a different length stands out.
+			width := -1
+			for _, record := range records[1:] {
+				cell := csvCell(record, column)
+				if width == -1 {
+					width = len(cell)
+				} else if len(cell) != width {
+					width = -2
+					break
+				}
+			}
+			if width >= 0 {
+				if len(value) != width {
+					votes++
+				} else {
+					votes--
+				}
+			}
+		default:
+			if value != "" && mergeColumnTypes(columnType, classifyCSVValue(value)) == columnType {
+				votes--
+			} else {
+				votes++
+			}
+		}
+	}
+	return votes >= 0
+}
+
+// loadCSVDialect returns the dialect recorded at upload time, sniffing the
+// file again if none was recorded.
+func loadCSVDialect(path string) (CSVDialect, error) {
+	data, err := os.ReadFile(path + csvDialectSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return sniffCSVDialect(path)
+	}
+	if err != nil {
+		return CSVDialect{}, err
+	}
+
+	var dialect CSVDialect
+	if err := json.Unmarshal(data, &dialect); err != nil {
+		return CSVDialect{}, fmt.Errorf("failed to parse %s: %v", path+csvDialectSuffix, err)
+	}
+	return dialect, nil
+}
+
+// saveCSVDialect records the dialect next to the CSV file.
+func saveCSVDialect(path string, dialect CSVDialect) error {
+	data, err := json.MarshalIndent(dialect, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+csvDialectSuffix, data, 0644)
+}
+
+// applyCSVDialectOverrides applies the delimiter, quote, header and encoding
+// query parameters to a dialect.
+func applyCSVDialectOverrides(c *gin.Context, dialect CSVDialect) (CSVDialect, error) {
+	if raw := c.Query("delimiter"); raw != "" {
+		switch raw {
+		case "tab", `\t`:
+			raw = "\t"
+		case "comma":
+			raw = ","
+		case "semicolon":
+			raw = ";"
+		case "pipe":
+			raw = "|"
+		}
+		if utf8.RuneCountInString(raw) != 1 || strings.ContainsAny(raw, "\r\n\"'") || raw == string(utf8.RuneError) {
+			return dialect, fmt.Errorf("invalid delimiter %q", raw)
+		}
+		dialect.Delimiter = raw
+	}
+
+	if raw := c.Query("quote"); raw != "" {
+		if raw != `"` && raw != "'" {
+			return dialect, fmt.Errorf("invalid quote %q, expected \" or '", raw)
+		}
+		dialect.Quote = raw
+	}
+
+	if raw := c.Query("header"); raw != "" {
+		hasHeader, err := strconv.ParseBool(raw)
+		if err != nil {
+			return dialect, fmt.Errorf("invalid header %q, expected true or false", raw)
+		}
+		dialect.HasHeader = hasHeader
+	}
+
+	if raw := strings.ToLower(c.Query("encoding")); raw != "" {
+		switch raw {
+		case "utf8":
+			raw = csvEncodingUTF8
+		case "gb2312", "gb18030":
+			raw = csvEncodingGBK
+		}
+		switch raw {
+		case csvEncodingUTF8, csvEncodingUTF16LE, csvEncodingUTF16BE, csvEncodingGBK:
+		default:
+			return dialect, fmt.Errorf("unsupported encoding %q", raw)
+		}
+		if raw != dialect.Encoding {
+			dialect.BOM = false
+		}
+		dialect.Encoding = raw
+	}
+
+	return dialect, nil
+}
@@ -0,0 +1,251 @@
+package tools
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// encodeCSVFixture encodes text, failing the test on characters the
+// encoding cannot represent.
+func encodeCSVFixture(t *testing.T, enc encoding.Encoding, text string) []byte {
+	t.Helper()
+	data, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSniffCSVDialect(t *testing.T) {
+	const chinese = "trade_id,名称,金额\n1,债券,1.5\n2,外汇,2.5\n3,利率,-0.5\n"
+	chineseHeaders := []string{"trade_id", "名称", "金额"}
+	utf16LE := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	utf16BE := unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	utf16LEBOM := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	utf16BEBOM := unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    CSVDialect
+		first   []string // Headers, or the first data row without a header.
+	}{
+		{
+			name:    "comma",
+			content: []byte("trade_id,book,pv\n1,FX,1.5\n2,IR,2.5\n3,FX,-0.5\n"),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8},
+			first:   []string{"trade_id", "book", "pv"},
+		},
+		{
+			name:    "semicolon",
+			content: []byte("trade_id;book;pv\n1;FX;1.5\n2;IR;2.5\n"),
+			want:    CSVDialect{Delimiter: ";", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8},
+			first:   []string{"trade_id", "book", "pv"},
+		},
+		{
+			name:    "semicolon with quoted commas",
+			content: []byte("trade_id;note\n1;\"a, b\"\n2;\"c, d, e\"\n3;\"f\"\n"),
+			want:    CSVDialect{Delimiter: ";", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8},
+			first:   []string{"trade_id", "note"},
+		},
+		{
+			name:    "tab",
+			content: []byte("trade_id\tbook\tpv\n1\tFX\t1.5\n2\tIR\t2.5\n"),
+			want:    CSVDialect{Delimiter: "\t", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8},
+			first:   []string{"trade_id", "book", "pv"},
+		},
+		{
+			name:    "pipe",
+			content: []byte("trade_id|book|pv\n1|FX|1.5\n2|IR|2.5\n"),
+			want:    CSVDialect{Delimiter: "|", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8},
+			first:   []string{"trade_id", "book", "pv"},
+		},
+		{
+			name:    "single quote",
+			content: []byte("trade_id,note\n1,'a, b'\n2,'it''s'\n3,'say \"hi\"'\n"),
+			want:    CSVDialect{Delimiter: ",", Quote: "'", HasHeader: true, Encoding: csvEncodingUTF8},
+			first:   []string{"trade_id", "note"},
+		},
+		{
+			name:    "no header",
+			content: []byte("1,FX,1.5\n2,IR,2.5\n3,FX,-0.5\n"),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, Encoding: csvEncodingUTF8},
+			first:   []string{"1", "FX", "1.5"},
+		},
+		{
+			name:    "no header with dates",
+			content: []byte("2024-01-02;100\n2024-01-03;250\n2024-01-04;75\n"),
+			want:    CSVDialect{Delimiter: ";", Quote: `"`, Encoding: csvEncodingUTF8},
+			first:   []string{"2024-01-02", "100"},
+		},
+		{
+			name:    "header over fixed-width codes",
+			content: []byte("currency,amount\nUSD,1\nEUR,2\nGBP,3\n"),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8},
+			first:   []string{"currency", "amount"},
+		},
+		{
+			name:    "single record",
+			content: []byte("trade_id,book\n"),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8},
+			first:   []string{"trade_id", "book"},
+		},
+		{
+			name:    "utf-8 with bom",
+			content: append(append([]byte{}, utf8BOM...), chinese...),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8, BOM: true},
+			first:   chineseHeaders,
+		},
+		{
+			name:    "utf-16le with bom",
+			content: encodeCSVFixture(t, utf16LEBOM, chinese),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF16LE, BOM: true},
+			first:   chineseHeaders,
+		},
+		{
+			name:    "utf-16le without bom",
+			content: encodeCSVFixture(t, utf16LE, chinese),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF16LE},
+			first:   chineseHeaders,
+		},
+		{
+			name:    "utf-16be with bom",
+			content: encodeCSVFixture(t, utf16BEBOM, chinese),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF16BE, BOM: true},
+			first:   chineseHeaders,
+		},
+		{
+			name:    "utf-16be without bom",
+			content: encodeCSVFixture(t, utf16BE, chinese),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF16BE},
+			first:   chineseHeaders,
+		},
+		{
+			name:    "utf-16le tab without bom",
+			content: encodeCSVFixture(t, utf16LE, strings.ReplaceAll(chinese, ",", "\t")),
+			want:    CSVDialect{Delimiter: "\t", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF16LE},
+			first:   chineseHeaders,
+		},
+		{
+			name:    "gbk",
+			content: encodeCSVFixture(t, simplifiedchinese.GBK, chinese),
+			want:    CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingGBK},
+			first:   chineseHeaders,
+		},
+		{
+			name:    "gbk semicolon without header",
+			content: encodeCSVFixture(t, simplifiedchinese.GBK, "1;债券;1.5\n2;外汇;2.5\n3;利率;-0.5\n"),
+			want:    CSVDialect{Delimiter: ";", Quote: `"`, Encoding: csvEncodingGBK},
+			first:   []string{"1", "债券", "1.5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trades.csv")
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			dialect, err := sniffCSVDialect(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dialect != tt.want {
+				t.Fatalf("dialect = %+v, want %+v", dialect, tt.want)
+			}
+
+			// The sniffed dialect reads the file back.
+			source, err := openCSVSource(path, dialect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close()
+			first := source.Headers
+			if !dialect.HasHeader {
+				if first, err = source.Read(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(first, tt.first) {
+				t.Errorf("first record = %q, want %q", first, tt.first)
+			}
+			if source.WarningCount != 0 {
+				t.Errorf("warnings = %+v", source.Warnings)
+			}
+		})
+	}
+}
+
+func TestSniffCSVDialectSingleQuoteFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.csv")
+	if err := os.WriteFile(path, []byte("trade_id,note\n1,'a, b'\n2,'it''s'\n3,'say \"hi\"'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dialect, err := sniffCSVDialect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := streamCSVRows(t, path, dialect)
+	if notes := []string{rows[0][1], rows[1][1], rows[2][1]}; !reflect.DeepEqual(notes, []string{"a, b", "it's", `say "hi"`}) {
+		t.Errorf("notes = %q", notes)
+	}
+}
+
+func TestSniffCSVEncoding(t *testing.T) {
+	tests := []struct {
+		name      string
+		sample    []byte
+		truncated bool
+		encoding  string
+		bom       bool
+	}{
+		{"ascii", []byte("a,b\n1,2\n"), false, csvEncodingUTF8, false},
+		{"empty", nil, false, csvEncodingUTF8, false},
+		{"utf-8", []byte("a,é\n"), false, csvEncodingUTF8, false},
+		{"utf-8 bom", []byte("\xEF\xBB\xBFa,b\n"), false, csvEncodingUTF8, true},
+		{"utf-16le bom", []byte("\xFF\xFEa\x00"), false, csvEncodingUTF16LE, true},
+		{"utf-16be bom", []byte("\xFE\xFF\x00a"), false, csvEncodingUTF16BE, true},
+		{"utf-16le", []byte("a\x00,\x00b\x00\n\x00"), false, csvEncodingUTF16LE, false},
+		{"utf-16be", []byte("\x00a\x00,\x00b\x00\n"), false, csvEncodingUTF16BE, false},
+		// A sample cut inside a multi-byte character is still UTF-8, but a
+		// whole file ending that way is not.
+		{"utf-8 cut by the sample", []byte("a,\xC3"), true, csvEncodingUTF8, false},
+		{"utf-8 cut in a long character", []byte("a,\xE4\xBA"), true, csvEncodingUTF8, false},
+		{"cut character at end of file", []byte("a,\xC3"), false, csvEncodingGBK, false},
+		{"gbk", []byte("a,\xB2\xE2\xCA\xD4\n"), false, csvEncodingGBK, false},
+	}
+	for _, tt := range tests {
+		encoding, bom := sniffCSVEncoding(tt.sample, tt.truncated)
+		if encoding != tt.encoding || bom != tt.bom {
+			t.Errorf("%s: got %s, bom %v, want %s, bom %v", tt.name, encoding, bom, tt.encoding, tt.bom)
+		}
+	}
+}
+
+func TestSniffCSVDialectTruncatedSample(t *testing.T) {
+	// A multi-byte character straddles the end of the sample.
+	var b strings.Builder
+	b.WriteString("trade_id,book\n")
+	for b.Len() < csvSniffBytes-1 {
+		b.WriteString("1,FX\n")
+	}
+	content := b.String()[:csvSniffBytes-1] + "é\n2,IR\n"
+	path := filepath.Join(t.TempDir(), "large.csv")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dialect, err := sniffCSVDialect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8}); dialect != want {
+		t.Errorf("dialect = %+v, want %+v", dialect, want)
+	}
+}
@@ -0,0 +1,378 @@
+package tools
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// csvIndexStride is the number of data rows between indexed offsets.
+	// Serving a page seeks to the nearest indexed row and skips the rest.
+	csvIndexStride = 1000
+
+	csvIndexMagic  = "CSVIDX2\n"
+	csvIndexSuffix = ".idx"
+)
+
+// Index build states.
+const (
+	csvIndexBuilding = "building"
+	csvIndexReady    = "ready"
+	csvIndexFailed   = "failed"
+	csvIndexMissing  = "missing"
+	// The index relies on decoded and file offsets agreeing, so only UTF-8
+	// files are indexed.
+	csvIndexUnsupported = "unsupported"
+)
+
+// csvIndex holds the byte offset of every csvIndexStride-th data row.
+type csvIndex struct {
+	fileSize  int64
+	modTime   int64
+	totalRows int64
+	offsets   []int64 // offsets[k] is the start of data row k*csvIndexStride.
+
+	// The dialect the offsets were computed with.
+	delimiter rune
+	quote     rune
+	hasHeader bool
+}
+
+// CSVIndexStatus reports the progress of an index build.
+type CSVIndexStatus struct {
+	State      string  `json:"state"`
+	BytesRead  int64   `json:"bytes_read"`
+	TotalBytes int64   `json:"total_bytes"`
+	Progress   float64 `json:"progress"` // Between 0 and 1.
+	TotalRows  int64   `json:"total_rows,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// csvIndexBuild tracks one background build.
+type csvIndexBuild struct {
+	bytesRead  atomic.Int64
+	totalBytes int64
+	state      atomic.Value // string
+	err        error
+	totalRows  int64
+}
+
+// csvIndexer runs background index builds and remembers their progress.
+type csvIndexer struct {
+	mu     sync.Mutex
+	builds map[string]*csvIndexBuild
+}
+
+var csvIndexes = &csvIndexer{builds: make(map[string]*csvIndexBuild)}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Start builds the index for a CSV file in the background.
+func (x *csvIndexer) Start(path string, dialect CSVDialect) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.start(path, dialect)
+}
+
+// start starts a build with x.mu held.
+func (x *csvIndexer) start(path string, dialect CSVDialect) {
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Failed to index %s: %v", path, err)
+		return
+	}
+
+	build := &csvIndexBuild{totalBytes: info.Size()}
+	build.state.Store(csvIndexBuilding)
+	if dialect.Encoding != csvEncodingUTF8 {
+		build.err = fmt.Errorf("row index is not available for %s files", dialect.Encoding)
+		build.state.Store(csvIndexUnsupported)
+	}
+
+	x.builds[path] = build
+	if build.err != nil {
+		return
+	}
+
+	go func() {
+		index, err := buildCSVIndex(path, dialect, &build.bytesRead)
+		if err == nil {
+			err = saveCSVIndex(path+csvIndexSuffix, index)
+		}
+		if err != nil {
+			log.Printf("Failed to index %s: %v", path, err)
+			build.err = err
+			build.state.Store(csvIndexFailed)
+			return
+		}
+		build.totalRows = index.totalRows
+		build.state.Store(csvIndexReady)
+	}()
+}
+
+// Load returns the persisted index of a CSV file read with the given
+// dialect. A missing or stale index of the recorded dialect is rebuilt in the
+// background, and the file is streamed until the rebuild is ready.
+func (x *csvIndexer) Load(path string, dialect CSVDialect) (*csvIndex, error) {
+	index, err := loadCSVIndex(path, dialect)
+	if err == nil {
+		return index, nil
+	}
+
+	// Dialects overridden for a single request are not indexed, and builds
+	// in progress or known to fail are left alone.
+	if recorded, dialectErr := loadCSVDialect(path); dialectErr != nil || recorded != dialect {
+		return nil, err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if build := x.builds[path]; build == nil || build.state.Load().(string) == csvIndexReady {
+		x.start(path, dialect)
+	}
+	return nil, err
+}
+
+// Status reports the build progress, falling back to a persisted index
+// for files indexed before a restart.
+func (x *csvIndexer) Status(path string) CSVIndexStatus {
+	x.mu.Lock()
+	build := x.builds[path]
+	x.mu.Unlock()
+
+	if build == nil {
+		dialect, err := loadCSVDialect(path)
+		if err != nil {
+			return CSVIndexStatus{State: csvIndexMissing}
+		}
+		index, err := loadCSVIndex(path, dialect)
+		if err != nil {
+			return CSVIndexStatus{State: csvIndexMissing}
+		}
+		return CSVIndexStatus{
+			State:      csvIndexReady,
+			BytesRead:  index.fileSize,
+			TotalBytes: index.fileSize,
+			Progress:   1,
+			TotalRows:  index.totalRows,
+		}
+	}
+
+	status := CSVIndexStatus{
+		State:      build.state.Load().(string),
+		BytesRead:  build.bytesRead.Load(),
+		TotalBytes: build.totalBytes,
+	}
+	if status.TotalBytes > 0 {
+		status.Progress = float64(status.BytesRead) / float64(status.TotalBytes)
+	}
+	switch status.State {
+	case csvIndexReady:
+		status.Progress = 1
+		status.TotalRows = build.totalRows
+	case csvIndexFailed, csvIndexUnsupported:
+		status.Error = build.err.Error()
+	}
+	return status
+}
+
+// buildCSVIndex scans a UTF-8 CSV file once and records row offsets. Offsets
+// come from the CSV reader so quoted fields spanning lines are handled.
+func buildCSVIndex(path string, dialect CSVDialect, bytesRead *atomic.Int64) (*csvIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var base int64
+	if dialect.BOM {
+		base = int64(len(utf8BOM))
+		if _, err := file.Seek(base, io.SeekStart); err != nil {
+			return nil, err
+		}
+		bytesRead.Add(base)
+	}
+	reader := newCSVReader(countingReader{r: file, n: bytesRead}, dialect)
+
+	index := &csvIndex{fileSize: info.Size(), modTime: info.ModTime().UnixNano(), hasHeader: dialect.HasHeader}
+	index.delimiter, _ = utf8.DecodeRuneInString(dialect.Delimiter)
+	index.quote, _ = utf8.DecodeRuneInString(dialect.Quote)
+
+	header := dialect.HasHeader
+	for {
+		offset := base + reader.InputOffset()
+		_, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// Skipped by csvSource as well, so it is not a data row.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header {
+			header = false
+			continue
+		}
+		if index.totalRows%csvIndexStride == 0 {
+			index.offsets = append(index.offsets, offset)
+		}
+		index.totalRows++
+	}
+
+	return index, nil
+}
+
+// saveCSVIndex writes the index atomically next to the CSV file.
+func saveCSVIndex(indexPath string, index *csvIndex) error {
+	tmpPath := indexPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	w.WriteString(csvIndexMagic)
+	hasHeader := int64(0)
+	if index.hasHeader {
+		hasHeader = 1
+	}
+	header := []int64{index.fileSize, index.modTime, csvIndexStride, index.totalRows, int64(len(index.offsets)),
+		int64(index.delimiter), int64(index.quote), hasHeader}
+	binary.Write(w, binary.LittleEndian, header)
+	binary.Write(w, binary.LittleEndian, index.offsets)
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, indexPath)
+}
+
+// loadCSVIndex reads the persisted index of a CSV file and checks that it
+// still describes the file read with the given dialect.
+func loadCSVIndex(path string, dialect CSVDialect) (*csvIndex, error) {
+	if dialect.Encoding != csvEncodingUTF8 {
+		return nil, errors.New("CSV index requires UTF-8")
+	}
+
+	file, err := os.Open(path + csvIndexSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(csvIndexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != csvIndexMagic {
+		return nil, errors.New("invalid CSV index")
+	}
+
+	header := make([]int64, 8)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	if header[2] != csvIndexStride || header[4] < 0 {
+		return nil, errors.New("unsupported CSV index layout")
+	}
+
+	index := &csvIndex{
+		fileSize:  header[0],
+		modTime:   header[1],
+		totalRows: header[3],
+		delimiter: rune(header[5]),
+		quote:     rune(header[6]),
+		hasHeader: header[7] == 1,
+	}
+	delimiter, _ := utf8.DecodeRuneInString(dialect.Delimiter)
+	quote, _ := utf8.DecodeRuneInString(dialect.Quote)
+	if index.delimiter != delimiter || index.quote != quote || index.hasHeader != dialect.HasHeader {
+		return nil, errors.New("CSV index was built with a different dialect")
+	}
+
+	index.offsets = make([]int64, header[4])
+	if err := binary.Read(r, binary.LittleEndian, index.offsets); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != index.fileSize || info.ModTime().UnixNano() != index.modTime {
+		return nil, errors.New("CSV index is stale")
+	}
+	return index, nil
+}
+
+// readCSVPage returns up to limit data rows starting at offset by seeking
+// the source to the nearest indexed row.
+func readCSVPage(source *csvSource, index *csvIndex, offset, limit int) ([][]string, error) {
+	rows := [][]string{}
+	if int64(offset) >= index.totalRows {
+		return rows, nil
+	}
+
+	block := offset / csvIndexStride
+	if err := source.seek(index.offsets[block], block*csvIndexStride); err != nil {
+		return nil, err
+	}
+
+	for row := block * csvIndexStride; len(rows) < limit; row++ {
+		record, err := source.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", row+1, err)
+		}
+		if row >= offset {
+			rows = append(rows, record)
+		}
+	}
+
+	return rows, nil
+}
+
+func HandleCSVIndexStatus(c *gin.Context) {
+	upload, ok := uploads.Resolve(c.Query("file"), uploadKindCSV)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, csvIndexes.Status(upload.Path))
+}
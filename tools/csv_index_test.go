@@ -0,0 +1,252 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeIndexedCSV writes a CSV file of rows data rows in the dialect. Rows
+// around the index strides hold quoted fields spanning several lines, and
+// row 1500 is ragged.
+func writeIndexedCSV(t *testing.T, path string, dialect CSVDialect, rows int) {
+	t.Helper()
+	q, d := dialect.Quote, dialect.Delimiter
+	var b strings.Builder
+	if dialect.BOM {
+		b.Write(utf8BOM)
+	}
+	if dialect.HasHeader {
+		b.WriteString("id" + d + "note" + d + "pv\n")
+	}
+	for i := 0; i < rows; i++ {
+		note := fmt.Sprintf("row %d", i)
+		switch i % csvIndexStride {
+		case csvIndexStride - 2, csvIndexStride - 1, 0, 1:
+			note = q + fmt.Sprintf("row %d\nsecond line%s with %s%squotes%s%s\r\nthird", i, d, q, q, q, q) + q
+		}
+		if i == 1500 {
+			b.WriteString(fmt.Sprintf("%d%s%s\n", i, d, note))
+			continue
+		}
+		b.WriteString(fmt.Sprintf("%d%s%s%s%d.5\n", i, d, note, d, i))
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// streamCSVRows reads every data row of a CSV file without the index.
+func streamCSVRows(t *testing.T, path string, dialect CSVDialect) [][]string {
+	t.Helper()
+	source, err := openCSVSource(path, dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	var rows [][]string
+	for {
+		record, err := source.Read()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, record)
+	}
+}
+
+func TestReadCSVPageMatchesStreaming(t *testing.T) {
+	const rows = 2600
+	tests := []struct {
+		name    string
+		dialect CSVDialect
+	}{
+		{"header", CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8}},
+		{"no header", CSVDialect{Delimiter: ",", Quote: `"`, Encoding: csvEncodingUTF8}},
+		{"bom", CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8, BOM: true}},
+		{"semicolon and single quote", CSVDialect{Delimiter: ";", Quote: "'", HasHeader: true, Encoding: csvEncodingUTF8}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trades.csv")
+			writeIndexedCSV(t, path, tt.dialect, rows)
+			want := streamCSVRows(t, path, tt.dialect)
+			if len(want) != rows || !strings.Contains(want[csvIndexStride][1], "\n") {
+				t.Fatalf("streamed %d rows, want %d with a multiline field at row %d", len(want), rows, csvIndexStride)
+			}
+
+			var bytesRead atomic.Int64
+			built, err := buildCSVIndex(path, tt.dialect, &bytesRead)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info, _ := os.Stat(path); bytesRead.Load() != info.Size() {
+				t.Errorf("read %d bytes of %d", bytesRead.Load(), info.Size())
+			}
+			if built.totalRows != int64(len(want)) || len(built.offsets) != (len(want)+csvIndexStride-1)/csvIndexStride {
+				t.Fatalf("index has %d rows and %d offsets", built.totalRows, len(built.offsets))
+			}
+			if err := saveCSVIndex(path+csvIndexSuffix, built); err != nil {
+				t.Fatal(err)
+			}
+			index, err := loadCSVIndex(path, tt.dialect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(index, built) {
+				t.Fatalf("loaded index %+v, want %+v", index, built)
+			}
+
+			source, err := openCSVSource(path, tt.dialect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close()
+			for _, offset := range []int{0, 1, 997, 998, 999, 1000, 1001, 1499, 1999, 2000, 2001, len(want) - 1, len(want), len(want) + 5} {
+				for _, limit := range []int{1, 3, 1000, 3000} {
+					page, err := readCSVPage(source, index, offset, limit)
+					if err != nil {
+						t.Fatalf("page %d+%d: %v", offset, limit, err)
+					}
+					end := offset + limit
+					if end > len(want) {
+						end = len(want)
+					}
+					wantPage := [][]string{}
+					if offset < len(want) {
+						wantPage = append(wantPage, want[offset:end]...)
+					}
+					if !reflect.DeepEqual(page, wantPage) {
+						t.Fatalf("page %d+%d does not match the streamed rows", offset, limit)
+					}
+				}
+			}
+			// Pages keep reporting the ragged row.
+			if len(source.Warnings) == 0 {
+				t.Error("no warning for the ragged row")
+			}
+		})
+	}
+}
+
+// waitForCSVIndex waits for the build of path to finish and checks that it
+// succeeded.
+func waitForCSVIndex(t *testing.T, x *csvIndexer, path string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := x.Status(path)
+		if status.State == csvIndexReady {
+			return
+		}
+		if status.State != csvIndexBuilding || time.Now().After(deadline) {
+			t.Fatalf("index build ended in state %s: %s", status.State, status.Error)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCSVIndexerRebuildsStaleIndex(t *testing.T) {
+	dialect := CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: csvEncodingUTF8}
+	path := filepath.Join(t.TempDir(), "trades.csv")
+	writeIndexedCSV(t, path, dialect, 1200)
+	if err := saveCSVDialect(path, dialect); err != nil {
+		t.Fatal(err)
+	}
+	x := &csvIndexer{builds: make(map[string]*csvIndexBuild)}
+	x.Start(path, dialect)
+	waitForCSVIndex(t, x, path)
+
+	index, err := x.Load(path, dialect)
+	if err != nil || index.totalRows != 1200 {
+		t.Fatalf("fresh index: %v", err)
+	}
+	build := x.builds[path]
+
+	// A dialect overridden for one request is not indexed.
+	override := dialect
+	override.Delimiter = ";"
+	if _, err := x.Load(path, override); err == nil {
+		t.Error("index used for a different delimiter")
+	}
+	if x.builds[path] != build {
+		t.Error("index rebuilt for a dialect override")
+	}
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T) CSVDialect
+		rows   int64
+	}{
+		{
+			name: "size",
+			change: func(t *testing.T) CSVDialect {
+				file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+				if _, err := file.WriteString("1200,appended,1.5\n"); err != nil {
+					t.Fatal(err)
+				}
+				return dialect
+			},
+			rows: 1201,
+		},
+		{
+			name: "mtime",
+			change: func(t *testing.T) CSVDialect {
+				later := time.Now().Add(time.Hour)
+				if err := os.Chtimes(path, later, later); err != nil {
+					t.Fatal(err)
+				}
+				return dialect
+			},
+			rows: 1201,
+		},
+		{
+			name: "dialect",
+			change: func(t *testing.T) CSVDialect {
+				changed := dialect
+				changed.HasHeader = false
+				if err := saveCSVDialect(path, changed); err != nil {
+					t.Fatal(err)
+				}
+				return changed
+			},
+			rows: 1202,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := tt.change(t)
+			if _, err := x.Load(path, current); err == nil {
+				t.Fatal("stale index used")
+			}
+			waitForCSVIndex(t, x, path)
+			index, err := x.Load(path, current)
+			if err != nil {
+				t.Fatalf("rebuilt index: %v", err)
+			}
+			if index.totalRows != tt.rows {
+				t.Errorf("rebuilt index has %d rows, want %d", index.totalRows, tt.rows)
+			}
+			if want := streamCSVRows(t, path, current); int64(len(want)) != index.totalRows {
+				t.Errorf("index has %d rows, streaming reads %d", index.totalRows, len(want))
+			}
+		})
+	}
+
+	if _, err := loadCSVIndex(path, dialect); err == nil {
+		t.Error("index of the old dialect still loads")
+	}
+}
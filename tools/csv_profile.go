@@ -0,0 +1,374 @@
+package tools
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// csvProfileExactLimit is the number of distinct values per column counted
+	// exactly; beyond it distinct counts and top values become approximate.
+	csvProfileExactLimit = 10000
+	// csvProfileSampleSize is the reservoir size used for histograms.
+	csvProfileSampleSize = 10000
+	// hllPrecision gives 2^14 registers, about 0.8% standard error.
+	hllPrecision = 14
+)
+
+// thousandsPattern matches numbers written with thousands separators.
+var thousandsPattern = regexp.MustCompile(`^[-+]?\d{1,3}(,\d{3})+(\.\d+)?$`)
+
+// csvDateLayouts are the date formats recognised during type inference.
+var csvDateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006/01/02",
+	"02-Jan-2006",
+	"01/02/2006",
+}
+
+// ColumnProfile describes the values of one CSV column.
+type ColumnProfile struct {
+	Name                 string         `json:"name"`
+	Type                 string         `json:"type"`
+	Count                int64          `json:"count"` // Non-empty values.
+	NullCount            int64          `json:"null_count"`
+	DistinctCount        int64          `json:"distinct_count"`
+	DistinctApproximate  bool           `json:"distinct_approximate"`
+	Min                  string         `json:"min,omitempty"`
+	Max                  string         `json:"max,omitempty"`
+	Mean                 *float64       `json:"mean,omitempty"`
+	StdDev               *float64       `json:"stddev,omitempty"`
+	TopValues            []ValueCount   `json:"top_values"`
+	TopApproximate       bool           `json:"top_approximate"`
+	Histogram            []HistogramBin `json:"histogram,omitempty"`
+	HistogramApproximate bool           `json:"histogram_approximate,omitempty"`
+}
+
+// ValueCount is a value and the number of times it occurs.
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// HistogramBin counts numeric values in [Lower, Upper).
+type HistogramBin struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	Count int64   `json:"count"`
+}
+
+// classifyCSVValue returns the most specific type of a non-empty value.
+func classifyCSVValue(value string) string {
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return "integer"
+	}
+	if _, ok := parseFiniteFloat(value); ok {
+		return "float"
+	}
+	if thousandsPattern.MatchString(value) {
+		return "decimal"
+	}
+	switch strings.ToLower(value) {
+	case "true", "false", "yes", "no":
+		return "boolean"
+	}
+	if _, ok := parseCSVDate(value); ok {
+		return "date"
+	}
+	return "string"
+}
+
+// mergeColumnTypes combines the type seen so far with the type of a new value.
+func mergeColumnTypes(current, next string) string {
+	if current == "" || current == next {
+		return next
+	}
+	numeric := map[string]int{"integer": 1, "float": 2, "decimal": 3}
+	if numeric[current] > 0 && numeric[next] > 0 {
+		if numeric[current] > numeric[next] {
+			return current
+		}
+		return next
+	}
+	return "string"
+}
+
+// isNumericColumnType reports whether values of the type parse as numbers.
+func isNumericColumnType(columnType string) bool {
+	return columnType == "integer" || columnType == "float" || columnType == "decimal"
+}
+
+// parseCSVNumber parses integers, floats and numbers with thousands separators.
+// NaN and infinities are not numbers.
+func parseCSVNumber(value string) (float64, bool) {
+	if thousandsPattern.MatchString(value) {
+		value = strings.ReplaceAll(value, ",", "")
+	}
+	return parseFiniteFloat(value)
+}
+
+// parseFiniteFloat parses a float, rejecting NaN and infinities, which
+// break statistics and cannot be encoded as JSON.
+func parseFiniteFloat(value string) (float64, bool) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, false
+	}
+	return number, true
+}
+
+// parseCSVDate parses a value with any of the recognised date layouts.
+func parseCSVDate(value string) (time.Time, bool) {
+	for _, layout := range csvDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// hyperLogLog estimates the number of distinct values in constant memory.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) Add(value string) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(value))
+	x := hasher.Sum64()
+	// Finalise with the splitmix64 mixer; FNV alone clusters its low bits.
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	register := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[register] {
+		h.registers[register] = rank
+	}
+}
+
+func (h *hyperLogLog) Estimate() int64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// columnProfiler accumulates a ColumnProfile over a stream of values.
+type columnProfiler struct {
+	profile ColumnProfile
+	rng     *rand.Rand
+
+	// Value frequencies: exact until csvProfileExactLimit distinct values,
+	// then maintained with the Misra-Gries heavy hitters algorithm.
+	counts map[string]int64
+	hll    *hyperLogLog
+
+	// Numeric statistics (Welford's online algorithm).
+	numericCount int64
+	mean, m2     float64
+	minNumber    float64
+	maxNumber    float64
+	sample       []float64
+
+	// Ordering of non-numeric values.
+	minString, maxString string
+	minDate, maxDate     time.Time
+}
+
+func newColumnProfiler(name string, rng *rand.Rand) *columnProfiler {
+	return &columnProfiler{
+		profile: ColumnProfile{Name: name},
+		rng:     rng,
+		counts:  make(map[string]int64),
+		hll:     newHyperLogLog(),
+	}
+}
+
+// Add records one cell value.
+func (p *columnProfiler) Add(value string) {
+	if value == "" {
+		p.profile.NullCount++
+		return
+	}
+	p.profile.Count++
+	p.profile.Type = mergeColumnTypes(p.profile.Type, classifyCSVValue(value))
+	p.hll.Add(value)
+	p.addCount(value)
+
+	if p.profile.Count == 1 || value < p.minString {
+		p.minString = value
+	}
+	if p.profile.Count == 1 || value > p.maxString {
+		p.maxString = value
+	}
+
+	if number, ok := parseCSVNumber(value); ok {
+		p.addNumber(number)
+	} else if t, ok := parseCSVDate(value); ok {
+		if p.minDate.IsZero() || t.Before(p.minDate) {
+			p.minDate = t
+		}
+		if p.maxDate.IsZero() || t.After(p.maxDate) {
+			p.maxDate = t
+		}
+	}
+}
+
+func (p *columnProfiler) addCount(value string) {
+	if _, ok := p.counts[value]; ok || len(p.counts) < csvProfileExactLimit {
+		p.counts[value]++
+		return
+	}
+
+	// Misra-Gries: a new value on a full table decrements every counter.
+	p.profile.TopApproximate = true
+	for key, count := range p.counts {
+		if count <= 1 {
+			delete(p.counts, key)
+		} else {
+			p.counts[key] = count - 1
+		}
+	}
+}
+
+func (p *columnProfiler) addNumber(number float64) {
+	p.numericCount++
+	if p.numericCount == 1 || number < p.minNumber {
+		p.minNumber = number
+	}
+	if p.numericCount == 1 || number > p.maxNumber {
+		p.maxNumber = number
+	}
+
+	delta := number - p.mean
+	p.mean += delta / float64(p.numericCount)
+	p.m2 += delta * (number - p.mean)
+
+	// Reservoir sampling keeps a uniform sample for the histogram.
+	if len(p.sample) < csvProfileSampleSize {
+		p.sample = append(p.sample, number)
+	} else if k := p.rng.Int63n(p.numericCount); k < csvProfileSampleSize {
+		p.sample[k] = number
+	}
+}
+
+// Finish computes the final profile.
+func (p *columnProfiler) Finish(topN, bins int) ColumnProfile {
+	profile := p.profile
+	if profile.Type == "" {
+		profile.Type = "empty"
+	}
+
+	if profile.TopApproximate {
+		profile.DistinctCount = p.hll.Estimate()
+		profile.DistinctApproximate = true
+	} else {
+		profile.DistinctCount = int64(len(p.counts))
+	}
+
+	profile.TopValues = topValueCounts(p.counts, topN)
+
+	switch {
+	case isNumericColumnType(profile.Type):
+		profile.Min = strconv.FormatFloat(p.minNumber, 'g', -1, 64)
+		profile.Max = strconv.FormatFloat(p.maxNumber, 'g', -1, 64)
+		mean := p.mean
+		profile.Mean = &mean
+		stddev := 0.0
+		if p.numericCount > 1 {
+			stddev = math.Sqrt(p.m2 / float64(p.numericCount-1))
+		}
+		profile.StdDev = &stddev
+		profile.Histogram = p.histogram(bins)
+		profile.HistogramApproximate = p.numericCount > int64(len(p.sample))
+	case profile.Type == "date":
+		profile.Min = p.minDate.Format(time.RFC3339)
+		profile.Max = p.maxDate.Format(time.RFC3339)
+	case profile.Count > 0:
+		profile.Min = p.minString
+		profile.Max = p.maxString
+	}
+
+	return profile
+}
+
+// histogram bins the sampled values between the exact minimum and maximum,
+// scaling counts up when the values were sampled.
+func (p *columnProfiler) histogram(bins int) []HistogramBin {
+	if len(p.sample) == 0 || bins <= 0 {
+		return nil
+	}
+
+	width := (p.maxNumber - p.minNumber) / float64(bins)
+	if width == 0 {
+		return []HistogramBin{{Lower: p.minNumber, Upper: p.maxNumber, Count: p.numericCount}}
+	}
+
+	counts := make([]int64, bins)
+	for _, value := range p.sample {
+		bin := int((value - p.minNumber) / width)
+		if bin >= bins {
+			bin = bins - 1
+		}
+		counts[bin]++
+	}
+
+	scale := float64(p.numericCount) / float64(len(p.sample))
+	histogram := make([]HistogramBin, bins)
+	for i := range histogram {
+		histogram[i] = HistogramBin{
+			Lower: p.minNumber + float64(i)*width,
+			Upper: p.minNumber + float64(i+1)*width,
+			Count: int64(float64(counts[i])*scale + 0.5),
+		}
+	}
+	return histogram
+}
+
+// topValueCounts returns the n most frequent values, ties broken by value.
+func topValueCounts(counts map[string]int64, n int) []ValueCount {
+	values := make([]ValueCount, 0, len(counts))
+	for value, count := range counts {
+		values = append(values, ValueCount{Value: value, Count: count})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Count != values[j].Count {
+			return values[i].Count > values[j].Count
+		}
+		return values[i].Value < values[j].Value
+	})
+	if len(values) > n {
+		values = values[:n]
+	}
+	return values
+}
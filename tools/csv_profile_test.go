@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetCSVStatsNonFiniteValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.csv")
+	content := "id,pv,delta\n1,1.5,Inf\n2,NaN,-Infinity\n3,2,1\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dialect := CSVDialect{Delimiter: ",", Quote: `"`, HasHeader: true, Encoding: "utf-8"}
+	stats, err := GetCSVStats(path, dialect, csvDefaultTopValues, csvDefaultBins)
+	if err != nil {
+		t.Fatalf("GetCSVStats: %v", err)
+	}
+	if _, err := json.Marshal(stats); err != nil {
+		t.Fatalf("stats cannot be encoded: %v", err)
+	}
+
+	for _, column := range stats.Columns[1:] {
+		if column.Type != "string" {
+			t.Errorf("column %s: type %q, want string", column.Name, column.Type)
+		}
+		if column.Mean != nil || column.Histogram != nil {
+			t.Errorf("column %s: got numeric statistics for non-finite values", column.Name)
+		}
+	}
+}
+
+func TestParseCSVNumber(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{"42", 42, true},
+		{"-1.5e3", -1500, true},
+		{"1,234,567.5", 1234567.5, true},
+		{"NaN", 0, false},
+		{"nan", 0, false},
+		{"Inf", 0, false},
+		{"+Inf", 0, false},
+		{"-Infinity", 0, false},
+		{"1e400", 0, false},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseCSVNumber(tt.value)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseCSVNumber(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestClassifyCSVValueNonFinite(t *testing.T) {
+	for _, value := range []string{"NaN", "Inf", "-inf", "Infinity"} {
+		if got := classifyCSVValue(value); got != "string" {
+			t.Errorf("classifyCSVValue(%q) = %q, want string", value, got)
+		}
+	}
+	if got := classifyCSVValue("1.5"); got != "float" {
+		t.Errorf("classifyCSVValue(%q) = %q, want float", "1.5", got)
+	}
+}
@@ -0,0 +1,246 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CSV filter operators.
+const (
+	csvFilterEquals   = "eq"
+	csvFilterContains = "contains"
+	csvFilterRange    = "range"
+	csvFilterRegex    = "regex"
+)
+
+// csvTypeSampleRows is the number of rows used to infer sort column types.
+const csvTypeSampleRows = 1000
+
+// csvFilter is a single "column:op:value" filter expression.
+type csvFilter struct {
+	column int
+	op     string
+	value  string
+	lo, hi string // Bounds of a range filter; empty means unbounded.
+	re     *regexp.Regexp
+}
+
+// csvSortKey orders rows by one column.
+type csvSortKey struct {
+	column     int
+	descending bool
+	columnType string // Inferred with analyzeColumnType.
+}
+
+// csvColumnIndex resolves a column by header name, falling back to a
+// zero-based column index.
+func csvColumnIndex(headers []string, column string) (int, error) {
+	for i, header := range headers {
+		if header == column {
+			return i, nil
+		}
+	}
+	if index, err := strconv.Atoi(column); err == nil && index >= 0 && index < len(headers) {
+		return index, nil
+	}
+	return -1, fmt.Errorf("unknown column %q", column)
+}
+
+// parseCSVFilters parses filter expressions of the form "column:op:value".
+func parseCSVFilters(expressions []string, headers []string) ([]csvFilter, error) {
+	var filters []csvFilter
+
+	for _, expression := range expressions {
+		parts := splitCSVFilter(expression, headers)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid filter %q, expected column:op:value", expression)
+		}
+
+		column, err := csvColumnIndex(headers, parts[0])
+		if err != nil {
+			return nil, err
+		}
+		filter := csvFilter{column: column, op: parts[1], value: parts[2]}
+
+		switch filter.op {
+		case csvFilterEquals, csvFilterContains:
+		case csvFilterRange:
+			bounds := strings.SplitN(filter.value, "..", 2)
+			if len(bounds) != 2 {
+				return nil, fmt.Errorf("invalid range %q, expected lo..hi", filter.value)
+			}
+			filter.lo, filter.hi = bounds[0], bounds[1]
+		case csvFilterRegex:
+			if filter.re, err = regexp.Compile(filter.value); err != nil {
+				return nil, fmt.Errorf("invalid filter regex %q: %v", filter.value, err)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported filter operator %q", filter.op)
+		}
+
+		filters = append(filters, filter)
+	}
+
+	return filters, nil
+}
+
+// splitCSVFilter splits a filter expression into column, operator and value.
+// Column names may contain colons, so the expression is split before the
+// first known operator that follows a known column; otherwise it is split at
+// the first two colons.
+func splitCSVFilter(expression string, headers []string) []string {
+	for i := 0; i < len(expression); i++ {
+		if expression[i] != ':' {
+			continue
+		}
+		rest := expression[i+1:]
+		j := strings.Index(rest, ":")
+		if j < 0 {
+			break
+		}
+		switch rest[:j] {
+		case csvFilterEquals, csvFilterContains, csvFilterRange, csvFilterRegex:
+			if _, err := csvColumnIndex(headers, expression[:i]); err == nil {
+				return []string{expression[:i], rest[:j], rest[j+1:]}
+			}
+		}
+	}
+	return strings.SplitN(expression, ":", 3)
+}
+
+// parseCSVSort parses a sort specification such as "price:desc,name".
+func parseCSVSort(spec string, headers []string) ([]csvSortKey, error) {
+	var keys []csvSortKey
+	if spec == "" {
+		return keys, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		// A column whose name contains a colon is sorted ascending when
+		// given alone.
+		column, direction := part, "asc"
+		if _, err := csvColumnIndex(headers, part); err != nil {
+			if i := strings.LastIndex(part, ":"); i >= 0 {
+				column, direction = part[:i], part[i+1:]
+			}
+		}
+		if direction != "asc" && direction != "desc" {
+			return nil, fmt.Errorf("invalid sort direction %q", direction)
+		}
+
+		index, err := csvColumnIndex(headers, column)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, csvSortKey{column: index, descending: direction == "desc"})
+	}
+
+	return keys, nil
+}
+
+// csvCell returns the value of a column, or "" for short rows.
+func csvCell(row []string, column int) string {
+	if column < len(row) {
+		return row[column]
+	}
+	return ""
+}
+
+// matchCSVFilters reports whether a row satisfies every filter.
+func matchCSVFilters(row []string, filters []csvFilter) bool {
+	for _, filter := range filters {
+		value := csvCell(row, filter.column)
+
+		switch filter.op {
+		case csvFilterEquals:
+			if value != filter.value {
+				return false
+			}
+		case csvFilterContains:
+			if !strings.Contains(value, filter.value) {
+				return false
+			}
+		case csvFilterRange:
+			if filter.lo != "" && compareCSVValues(value, filter.lo, "") < 0 {
+				return false
+			}
+			if filter.hi != "" && compareCSVValues(value, filter.hi, "") > 0 {
+				return false
+			}
+		case csvFilterRegex:
+			if !filter.re.MatchString(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compareCSVValues orders two cells. Numeric column types, or an empty type
+// with two numeric values, compare numerically and date columns compare
+// chronologically; empty cells sort last.
+func compareCSVValues(a, b, columnType string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+
+	if columnType == "" || isNumericColumnType(columnType) {
+		x, okA := parseCSVNumber(a)
+		y, okB := parseCSVNumber(b)
+		if okA && okB {
+			return compareFloats(x, y)
+		}
+	}
+
+	if columnType == "date" {
+		x, okA := parseCSVDate(a)
+		y, okB := parseCSVDate(b)
+		if okA && okB {
+			return x.Compare(y)
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// sortCSVRows sorts rows in place by the sort keys, with empty cells last;
+// the sort is stable so file order breaks ties.
+func sortCSVRows(rows [][]string, keys []csvSortKey) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, key := range keys {
+			a, b := csvCell(rows[i], key.column), csvCell(rows[j], key.column)
+			if (a == "") != (b == "") {
+				// Empty cells sort last in either direction.
+				return b == ""
+			}
+			cmp := compareCSVValues(a, b, key.columnType)
+			if cmp == 0 {
+				continue
+			}
+			if key.descending {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+}
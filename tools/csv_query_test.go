@@ -0,0 +1,166 @@
+package tools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCSVFilters(t *testing.T) {
+	headers := []string{"trade_id", "time:utc", "book", "notional"}
+	tests := []struct {
+		expression string
+		column     int
+		op         string
+		value      string
+		lo, hi     string
+	}{
+		{"book:eq:FX", 2, csvFilterEquals, "FX", "", ""},
+		{"2:contains:F", 2, csvFilterContains, "F", "", ""},
+		{"book:eq:a:b", 2, csvFilterEquals, "a:b", "", ""},
+		{"book:eq:", 2, csvFilterEquals, "", "", ""},
+		{"notional:range:10..", 3, csvFilterRange, "10..", "10", ""},
+		{"notional:range:..1e6", 3, csvFilterRange, "..1e6", "", "1e6"},
+		{"time:utc:range:09:00..17:00", 1, csvFilterRange, "09:00..17:00", "09:00", "17:00"},
+		{"time:utc:regex:^1[0-2]:", 1, csvFilterRegex, "^1[0-2]:", "", ""},
+		{"1:eq:12:00", 1, csvFilterEquals, "12:00", "", ""},
+	}
+	for _, tt := range tests {
+		filters, err := parseCSVFilters([]string{tt.expression}, headers)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expression, err)
+			continue
+		}
+		filter := filters[0]
+		if filter.column != tt.column || filter.op != tt.op || filter.value != tt.value || filter.lo != tt.lo || filter.hi != tt.hi {
+			t.Errorf("%s: got column %d, op %s, value %q, range %q..%q", tt.expression, filter.column, filter.op, filter.value, filter.lo, filter.hi)
+		}
+	}
+
+	for _, expression := range []string{
+		"book",
+		"book:eq",
+		"desk:eq:FX",
+		"time:eq:12:00",
+		"book:like:FX",
+		"notional:range:10",
+		"book:regex:[",
+	} {
+		if _, err := parseCSVFilters([]string{expression}, headers); err == nil {
+			t.Errorf("%s: no error", expression)
+		}
+	}
+}
+
+func TestMatchCSVFilters(t *testing.T) {
+	headers := []string{"trade_id", "time:utc", "book", "notional"}
+	row := []string{"T1", "12:30", "FX", "1,500"}
+	tests := []struct {
+		expressions []string
+		match       bool
+	}{
+		{nil, true},
+		{[]string{"book:eq:FX"}, true},
+		{[]string{"book:eq:fx"}, false},
+		{[]string{"trade_id:contains:1"}, true},
+		{[]string{"notional:range:1000..2000"}, true},
+		{[]string{"notional:range:..999"}, false},
+		{[]string{"time:utc:regex:^12:"}, true},
+		{[]string{"book:eq:FX", "notional:range:2000.."}, false},
+	}
+	for _, tt := range tests {
+		filters, err := parseCSVFilters(tt.expressions, headers)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expressions, err)
+		}
+		if got := matchCSVFilters(row, filters); got != tt.match {
+			t.Errorf("%q: match = %v, want %v", tt.expressions, got, tt.match)
+		}
+	}
+
+	// Short rows have empty cells.
+	filters, _ := parseCSVFilters([]string{"notional:eq:"}, headers)
+	if !matchCSVFilters([]string{"T2"}, filters) {
+		t.Error("short row does not have an empty cell")
+	}
+}
+
+func TestParseCSVSort(t *testing.T) {
+	headers := []string{"trade_id", "time:utc", "notional", "x:desc"}
+	tests := []struct {
+		spec string
+		want []csvSortKey
+	}{
+		{"", nil},
+		{"notional", []csvSortKey{{column: 2}}},
+		{"notional:desc,trade_id", []csvSortKey{{column: 2, descending: true}, {column: 0}}},
+		{"2:asc", []csvSortKey{{column: 2}}},
+		{"time:utc", []csvSortKey{{column: 1}}},
+		{"time:utc:desc", []csvSortKey{{column: 1, descending: true}}},
+		{"x:desc", []csvSortKey{{column: 3}}},
+		{"x:desc:desc", []csvSortKey{{column: 3, descending: true}}},
+	}
+	for _, tt := range tests {
+		keys, err := parseCSVSort(tt.spec, headers)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, tt.want) {
+			t.Errorf("%q: keys = %+v, want %+v", tt.spec, keys, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"desk", "notional:down", "time", "notional,"} {
+		if _, err := parseCSVSort(spec, headers); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+// sortedColumn returns the given column of rows after sorting them by spec.
+func sortedColumn(t *testing.T, rows [][]string, headers []string, spec string, column int) []string {
+	t.Helper()
+	keys, err := parseCSVSort(spec, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows = append([][]string(nil), rows...)
+	inferCSVSortTypes(keys, rows)
+	sortCSVRows(rows, keys)
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		values[i] = csvCell(row, column)
+	}
+	return values
+}
+
+func TestSortCSVRows(t *testing.T) {
+	headers := []string{"id", "notional", "date", "book"}
+	rows := [][]string{
+		{"1", "10", "2024-03-01", "FX"},
+		{"2", "", "2024-01-15", "rates"},
+		{"3", "9", "", "FX"},
+		{"4", "1,000", "2023-12-31", ""},
+		{"5", "-2.5", "2024-01-15", "credit"},
+		{"6"},
+	}
+	tests := []struct {
+		spec   string
+		column int
+		want   []string
+	}{
+		{"notional", 0, []string{"5", "3", "1", "4", "2", "6"}},
+		{"notional:desc", 0, []string{"4", "1", "3", "5", "2", "6"}},
+		{"date", 0, []string{"4", "2", "5", "1", "3", "6"}},
+		{"date:desc", 0, []string{"1", "2", "5", "4", "3", "6"}},
+		{"book", 0, []string{"1", "3", "5", "2", "4", "6"}},
+		{"book:desc", 0, []string{"2", "5", "1", "3", "4", "6"}},
+		{"book:desc,notional", 0, []string{"2", "5", "3", "1", "4", "6"}},
+		{"book,notional:desc", 0, []string{"1", "3", "5", "2", "4", "6"}},
+	}
+	for _, tt := range tests {
+		if got := sortedColumn(t, rows, headers, tt.spec, tt.column); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ids = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
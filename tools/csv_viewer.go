@@ -1,9 +1,11 @@
 package tools
 
 import (
-	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -14,22 +16,27 @@ import (
 )
 
 type CSVViewerResult struct {
-	FileName     string     `json:"file_name"`
-	Headers      []string   `json:"headers"`
-	Rows         [][]string `json:"rows"`
-	TotalRows    int        `json:"total_rows"`
-	TotalColumns int        `json:"total_columns"`
-	PreviewRows  [][]string `json:"preview_rows"`
+	FileName     string       `json:"file_name"`
+	Headers      []string     `json:"headers"`
+	Rows         [][]string   `json:"rows"`         // The requested page of data rows.
+	TotalRows    int          `json:"total_rows"`   // Data rows in the file.
+	MatchedRows  int          `json:"matched_rows"` // Data rows passing the filters.
+	TotalColumns int          `json:"total_columns"`
+	Offset       int          `json:"offset"`
+	Limit        int          `json:"limit"`
+	Dialect      CSVDialect   `json:"dialect"`
+	Warnings     []CSVWarning `json:"warnings,omitempty"`
+	WarningCount int          `json:"warning_count,omitempty"` // Including warnings beyond the first csvMaxWarnings.
 }
 
-func HandleCSVUpload(c *gin.Context) {
-	// Create upload directory.
-	uploadDir := "uploads/csv"
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create upload directory"})
-		return
-	}
+// CSV paging defaults.
+const (
+	csvDefaultLimit = 100
+	csvMaxLimit     = 10000
+	csvPreviewLimit = 10
+)
 
+func HandleCSVUpload(c *gin.Context) {
 	// Retrieve uploaded file.
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -44,47 +51,158 @@ func HandleCSVUpload(c *gin.Context) {
 		return
 	}
 
-	// Generate unique file name.
-	timestamp := time.Now().UnixNano()
-	filename := fmt.Sprintf("%d_%s", timestamp, file.Filename)
-	filepath := filepath.Join(uploadDir, filename)
+	// Validate dialect overrides before saving anything.
+	if _, err := applyCSVDialectOverrides(c, CSVDialect{}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	if err := c.SaveUploadedFile(file, filepath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+	id, dialect, err := storeCSVUpload(c, file)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":  "CSV file uploaded successfully",
-		"file":     filepath,
+		"file":     id,
 		"filename": file.Filename,
+		"dialect":  dialect,
 	})
 }
 
+// storeCSVUpload saves an uploaded CSV file, records its dialect with the
+// request's overrides applied, registers it and starts building its row
+// index. It returns the upload ID.
+func storeCSVUpload(c *gin.Context, file *multipart.FileHeader) (string, CSVDialect, error) {
+	// Create upload directory.
+	uploadDir := "uploads/csv"
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return "", CSVDialect{}, errors.New("failed to create upload directory")
+	}
+
+	// Generate unique file name.
+	timestamp := time.Now().UnixNano()
+	filename := fmt.Sprintf("%d_%s", timestamp, file.Filename)
+	filePath := filepath.Join(uploadDir, filename)
+
+	if err := c.SaveUploadedFile(file, filePath); err != nil {
+		return "", CSVDialect{}, errors.New("failed to save file")
+	}
+
+	// Detect the dialect, letting query parameters override what was sniffed.
+	dialect, err := sniffCSVDialect(filePath)
+	if err != nil {
+		return "", dialect, errors.New("failed to read CSV file: " + err.Error())
+	}
+	if dialect, err = applyCSVDialectOverrides(c, dialect); err != nil {
+		return "", dialect, err
+	}
+	if err := saveCSVDialect(filePath, dialect); err != nil {
+		return "", dialect, errors.New("failed to save CSV dialect")
+	}
+
+	id, err := uploads.Register(uploadKindCSV, filePath, file.Filename)
+	if err != nil {
+		return "", dialect, errors.New("failed to register upload")
+	}
+
+	// Build the row index in the background; progress is exposed through
+	// /api/csv/index.
+	csvIndexes.Start(filePath, dialect)
+
+	return id, dialect, nil
+}
+
 func HandleCSVView(c *gin.Context) {
-	filePath := c.Query("file")
-	previewOnly := c.DefaultQuery("preview", "false")
-	previewRows := 10 // Default preview 10 rows.
+	fileID := c.Query("file")
 
-	if filePath == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file path parameter"})
+	if fileID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file parameter"})
+		return
+	}
+
+	upload, ok := uploads.Resolve(fileID, uploadKindCSV)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	offset, limit, err := parseCSVPage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dialect, err := loadCSVDialect(upload.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read CSV dialect: " + err.Error()})
+		return
+	}
+	if dialect, err = applyCSVDialectOverrides(c, dialect); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Read CSV file.
-	file, err := os.Open(filePath)
+	source, err := openCSVSource(upload.Path, dialect)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open file: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read CSV file: " + err.Error()})
 		return
 	}
-	defer file.Close()
+	defer source.Close()
 
-	reader := csv.NewReader(file)
+	headers := source.Headers
+	if len(headers) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file is empty"})
+		return
+	}
+
+	filters, err := parseCSVFilters(c.QueryArray("filter"), headers)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sortKeys, err := parseCSVSort(c.Query("sort"), headers)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := CSVViewerResult{
+		FileName:     upload.Name,
+		Headers:      headers,
+		Rows:         [][]string{},
+		TotalColumns: len(headers),
+		Offset:       offset,
+		Limit:        limit,
+		Dialect:      dialect,
+	}
 
-	// Read all rows.
-	var allRows [][]string
+	// Serve plain pages from the row index when it is ready.
+	if len(filters) == 0 && len(sortKeys) == 0 {
+		if index, err := csvIndexes.Load(upload.Path, dialect); err == nil {
+			rows, err := readCSVPage(source, index, offset, limit)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read CSV file: " + err.Error()})
+				return
+			}
+			result.Rows = rows
+			result.TotalRows = int(index.totalRows)
+			result.MatchedRows = result.TotalRows
+			result.Warnings, result.WarningCount = source.Warnings, source.WarningCount
+			c.JSON(http.StatusOK, result)
+			return
+		}
+	}
+
+	// Stream the rows. Without sorting only the requested page is kept; with
+	// sorting at most two pages' worth of the best rows is kept at a time.
+	window := offset + limit
+	var candidates [][]string
+	typed := false
 	for {
-		record, err := reader.Read()
+		record, err := source.Read()
 		if err == io.EOF {
 			break
 		}
@@ -92,137 +210,212 @@ func HandleCSVView(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read CSV file: " + err.Error()})
 			return
 		}
-		allRows = append(allRows, record)
+		result.TotalRows++
+
+		if !matchCSVFilters(record, filters) {
+			continue
+		}
+		result.MatchedRows++
+
+		if len(sortKeys) == 0 {
+			if result.MatchedRows > offset && result.MatchedRows <= window {
+				result.Rows = append(result.Rows, record)
+			}
+			continue
+		}
+
+		candidates = append(candidates, record)
+		if !typed && len(candidates) == csvTypeSampleRows {
+			inferCSVSortTypes(sortKeys, candidates)
+			typed = true
+		}
+		if typed && len(candidates) >= 2*window {
+			sortCSVRows(candidates, sortKeys)
+			candidates = candidates[:window]
+		}
 	}
 
-	if len(allRows) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file is empty"})
-		return
+	if len(sortKeys) > 0 {
+		if !typed {
+			inferCSVSortTypes(sortKeys, candidates)
+		}
+		sortCSVRows(candidates, sortKeys)
+		if offset < len(candidates) {
+			end := window
+			if end > len(candidates) {
+				end = len(candidates)
+			}
+			result.Rows = candidates[offset:end]
+		}
 	}
+	result.Warnings, result.WarningCount = source.Warnings, source.WarningCount
 
-	// Extract headers.
-	headers := allRows[0]
-	dataRows := allRows[1:]
+	c.JSON(http.StatusOK, result)
+}
 
-	// Calculate total rows and columns.
-	totalRows := len(dataRows)
-	totalColumns := len(headers)
+// parseCSVPage reads the offset and limit query parameters. preview=true is
+// shorthand for the first few rows.
+func parseCSVPage(c *gin.Context) (int, int, error) {
+	offset, limit := 0, csvDefaultLimit
+	if c.Query("preview") == "true" {
+		limit = csvPreviewLimit
+	}
 
-	// Prepare preview data.
-	var previewData [][]string
-	if previewOnly == "true" {
-		// Return preview data only.
-		previewData = append(previewData, headers) // Include header row.
-		for i := 0; i < previewRows && i < len(dataRows); i++ {
-			previewData = append(previewData, dataRows[i])
+	var err error
+	if raw := c.Query("offset"); raw != "" {
+		if offset, err = strconv.Atoi(raw); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", raw)
 		}
-	} else {
-		// Return all data.
-		previewData = allRows
 	}
+	if raw := c.Query("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 || limit > csvMaxLimit {
+			return 0, 0, fmt.Errorf("invalid limit %q, expected 1 to %d", raw, csvMaxLimit)
+		}
+	}
+	return offset, limit, nil
+}
 
-	result := CSVViewerResult{
-		FileName:     filepath.Base(filePath),
-		Headers:      headers,
-		Rows:         dataRows,
-		TotalRows:    totalRows,
-		TotalColumns: totalColumns,
-		PreviewRows:  previewData,
+// inferCSVSortTypes fixes the value type of each sort column from a sample
+// of rows so the ordering stays consistent while streaming.
+func inferCSVSortTypes(keys []csvSortKey, sample [][]string) {
+	for i := range keys {
+		columnType := analyzeColumnType(sample, keys[i].column)
+		if columnType == "empty" || columnType == "unknown" {
+			// Nothing to go on yet; compare numerically when both values allow it.
+			columnType = ""
+		}
+		keys[i].columnType = columnType
 	}
+}
 
-	c.JSON(http.StatusOK, result)
+// CSVStats profiles every column of a CSV file.
+type CSVStats struct {
+	FileName     string          `json:"file_name"`
+	Headers      []string        `json:"headers"`
+	TotalRows    int             `json:"total_rows"`
+	TotalColumns int             `json:"total_columns"`
+	Columns      []ColumnProfile `json:"columns"`
+	Dialect      CSVDialect      `json:"dialect"`
+	Warnings     []CSVWarning    `json:"warnings,omitempty"`
+	WarningCount int             `json:"warning_count,omitempty"`
 }
 
-// GetCSVStats returns summary information for a CSV file.
-func GetCSVStats(filePath string) (map[string]interface{}, error) {
-	file, err := os.Open(filePath)
+// Column profiling defaults.
+const (
+	csvDefaultTopValues = 10
+	csvMaxTopValues     = 1000
+	csvDefaultBins      = 10
+	csvMaxBins          = 1000
+)
+
+func HandleCSVStats(c *gin.Context) {
+	upload, ok := uploads.Resolve(c.Query("file"), uploadKindCSV)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+
+	dialect, err := loadCSVDialect(upload.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read CSV dialect: " + err.Error()})
+		return
+	}
+	if dialect, err = applyCSVDialectOverrides(c, dialect); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	topN, bins := csvDefaultTopValues, csvDefaultBins
+	if raw := c.Query("top"); raw != "" {
+		if topN, err = strconv.Atoi(raw); err != nil || topN < 0 || topN > csvMaxTopValues {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid top %q, expected 0 to %d", raw, csvMaxTopValues)})
+			return
+		}
+	}
+	if raw := c.Query("bins"); raw != "" {
+		if bins, err = strconv.Atoi(raw); err != nil || bins < 0 || bins > csvMaxBins {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid bins %q, expected 0 to %d", raw, csvMaxBins)})
+			return
+		}
+	}
+
+	stats, err := GetCSVStats(upload.Path, dialect, topN, bins)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to profile CSV file: " + err.Error()})
+		return
+	}
+	stats.FileName = upload.Name
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// GetCSVStats profiles a CSV file in a single streaming pass, keeping the
+// topN most frequent values and a histogram with the given number of bins
+// for numeric columns.
+func GetCSVStats(filePath string, dialect CSVDialect, topN, bins int) (*CSVStats, error) {
+	source, err := openCSVSource(filePath, dialect)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	defer source.Close()
 
-	reader := csv.NewReader(file)
+	stats := &CSVStats{Headers: []string{}, Columns: []ColumnProfile{}, Dialect: dialect}
+	if len(source.Headers) == 0 {
+		return stats, nil
+	}
+	stats.Headers = source.Headers
+	stats.TotalColumns = len(source.Headers)
+
+	rng := rand.New(rand.NewSource(1))
+	profilers := make([]*columnProfiler, len(stats.Headers))
+	for i, header := range stats.Headers {
+		profilers[i] = newColumnProfiler(header, rng)
+	}
 
-	var allRows [][]string
 	for {
-		record, err := reader.Read()
+		record, err := source.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-		allRows = append(allRows, record)
-	}
+		stats.TotalRows++
 
-	if len(allRows) == 0 {
-		return map[string]interface{}{
-			"total_rows":    0,
-			"total_columns": 0,
-		}, nil
+		for i, profiler := range profilers {
+			profiler.Add(csvCell(record, i))
+		}
 	}
 
-	headers := allRows[0]
-	dataRows := allRows[1:]
-
-	// Determine column data types.
-	columnTypes := make([]string, len(headers))
-	for i := range headers {
-		columnTypes[i] = analyzeColumnType(dataRows, i)
+	for _, profiler := range profilers {
+		stats.Columns = append(stats.Columns, profiler.Finish(topN, bins))
 	}
-
-	return map[string]interface{}{
-		"total_rows":    len(dataRows),
-		"total_columns": len(headers),
-		"headers":       headers,
-		"column_types":  columnTypes,
-	}, nil
+	stats.Warnings, stats.WarningCount = source.Warnings, source.WarningCount
+	return stats, nil
 }
 
-// analyzeColumnType inspects a column and returns its inferred type.
+// analyzeColumnType inspects a column and returns its inferred type: integer,
+// float, decimal, boolean, date, string, empty or unknown.
 func analyzeColumnType(rows [][]string, columnIndex int) string {
 	if len(rows) == 0 {
 		return "unknown"
 	}
 
-	isNumeric := true
-	isInteger := true
-	hasData := false
-
+	columnType := ""
 	for _, row := range rows {
-		if columnIndex >= len(row) {
-			continue
-		}
-
-		value := row[columnIndex]
+		value := csvCell(row, columnIndex)
 		if value == "" {
 			continue
 		}
 
-		hasData = true
-
-		// Try parsing as float.
-		if _, err := strconv.ParseFloat(value, 64); err != nil {
-			isNumeric = false
-			isInteger = false
+		columnType = mergeColumnTypes(columnType, classifyCSVValue(value))
+		if columnType == "string" {
 			break
 		}
-
-		// Try parsing as integer.
-		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
-			isInteger = false
-		}
 	}
 
-	if !hasData {
+	if columnType == "" {
 		return "empty"
 	}
-
-	if isInteger {
-		return "integer"
-	} else if isNumeric {
-		return "float"
-	} else {
-		return "string"
-	}
+	return columnType
 }
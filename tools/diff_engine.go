@@ -0,0 +1,332 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+)
+
+// DiffAlgorithm selects the line diff strategy.
+type DiffAlgorithm string
+
+const (
+	// DiffAlgorithmMyers produces a minimal edit script (Myers, linear space).
+	DiffAlgorithmMyers DiffAlgorithm = "myers"
+	// DiffAlgorithmPatience anchors on lines that are unique in both files
+	// and falls back to Myers between anchors. It keeps moved or repeated
+	// blocks readable at the cost of minimality.
+	DiffAlgorithmPatience DiffAlgorithm = "patience"
+)
+
+// parseDiffAlgorithm validates the algorithm query parameter.
+func parseDiffAlgorithm(value string) (DiffAlgorithm, error) {
+	switch DiffAlgorithm(value) {
+	case "", DiffAlgorithmMyers:
+		return DiffAlgorithmMyers, nil
+	case DiffAlgorithmPatience:
+		return DiffAlgorithmPatience, nil
+	default:
+		return "", fmt.Errorf("unsupported diff algorithm %q", value)
+	}
+}
+
+// lineDiffer marks the lines of a and b that are not part of the common
+// subsequence. Lines are interned to integers so comparisons are cheap.
+type lineDiffer struct {
+	a, b     []int
+	changedA []bool
+	changedB []bool
+
+	ctx context.Context
+	err error // Set once ctx is done; the remaining work is skipped.
+}
+
+// diffKeys computes which entries of keys1 and keys2 are changed.
+func diffKeys(keys1, keys2 []string, algorithm DiffAlgorithm) (changed1, changed2 []bool) {
+	changed1, changed2, _ = diffKeysContext(context.Background(), keys1, keys2, algorithm)
+	return changed1, changed2
+}
+
+// diffKeysContext is diffKeys stopping early with ctx's error once ctx is done.
+func diffKeysContext(ctx context.Context, keys1, keys2 []string, algorithm DiffAlgorithm) (changed1, changed2 []bool, err error) {
+	ids := make(map[string]int, len(keys1)+len(keys2))
+	intern := func(keys []string) []int {
+		out := make([]int, len(keys))
+		for i, key := range keys {
+			id, ok := ids[key]
+			if !ok {
+				id = len(ids)
+				ids[key] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+
+	d := &lineDiffer{
+		a:        intern(keys1),
+		b:        intern(keys2),
+		changedA: make([]bool, len(keys1)),
+		changedB: make([]bool, len(keys2)),
+		ctx:      ctx,
+	}
+
+	if algorithm == DiffAlgorithmPatience {
+		d.patience(0, len(d.a), 0, len(d.b))
+	} else {
+		d.myers(0, len(d.a), 0, len(d.b))
+	}
+
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	return d.changedA, d.changedB, nil
+}
+
+// cancelled reports whether the context is done, recording its error.
+func (d *lineDiffer) cancelled() bool {
+	if d.err == nil {
+		d.err = d.ctx.Err()
+	}
+	return d.err != nil
+}
+
+// trimCommon strips the common prefix and suffix of the given ranges.
+func (d *lineDiffer) trimCommon(aLo, aHi, bLo, bHi int) (int, int, int, int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		aLo++
+		bLo++
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+	return aLo, aHi, bLo, bHi
+}
+
+// markRange flags every line in the given ranges as changed.
+func (d *lineDiffer) markRange(aLo, aHi, bLo, bHi int) {
+	for i := aLo; i < aHi; i++ {
+		d.changedA[i] = true
+	}
+	for j := bLo; j < bHi; j++ {
+		d.changedB[j] = true
+	}
+}
+
+// myers runs the divide-and-conquer Myers algorithm on a[aLo:aHi] and b[bLo:bHi].
+func (d *lineDiffer) myers(aLo, aHi, bLo, bHi int) {
+	if d.cancelled() {
+		return
+	}
+	aLo, aHi, bLo, bHi = d.trimCommon(aLo, aHi, bLo, bHi)
+
+	if aLo == aHi || bLo == bHi {
+		d.markRange(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	x, y, ok := d.middleSnake(aLo, aHi, bLo, bHi)
+	if d.err != nil {
+		return
+	}
+	if !ok {
+		// No common line at all.
+		d.markRange(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	d.myers(aLo, aLo+x, bLo, bLo+y)
+	d.myers(aLo+x, aHi, bLo+y, bHi)
+}
+
+// middleSnake finds the split point of an optimal edit path by walking the
+// edit graph from both corners until the paths overlap. The returned
+// coordinates are relative to aLo and bLo. It gives up when the context is
+// done.
+func (d *lineDiffer) middleSnake(aLo, aHi, bLo, bHi int) (int, int, bool) {
+	a := d.a[aLo:aHi]
+	b := d.b[bLo:bHi]
+	n, m := len(a), len(b)
+
+	maxD := (n + m + 1) / 2
+	vOffset := maxD
+	vLength := 2*maxD + 2
+	v1 := make([]int, vLength)
+	v2 := make([]int, vLength)
+	for i := range v1 {
+		v1[i] = -1
+		v2[i] = -1
+	}
+	v1[vOffset+1] = 0
+	v2[vOffset+1] = 0
+
+	delta := n - m
+	// If the total number of lines is odd, the forward path overlaps first.
+	front := delta%2 != 0
+
+	// Diagonals that ran off the grid are skipped on later passes.
+	k1start, k1end, k2start, k2end := 0, 0, 0, 0
+
+	for step := 0; step < maxD; step++ {
+		if step%64 == 0 && d.cancelled() {
+			return 0, 0, false
+		}
+		for k1 := -step + k1start; k1 <= step-k1end; k1 += 2 {
+			k1Offset := vOffset + k1
+			var x1 int
+			if k1 == -step || (k1 != step && v1[k1Offset-1] < v1[k1Offset+1]) {
+				x1 = v1[k1Offset+1]
+			} else {
+				x1 = v1[k1Offset-1] + 1
+			}
+			y1 := x1 - k1
+			for x1 < n && y1 < m && a[x1] == b[y1] {
+				x1++
+				y1++
+			}
+			v1[k1Offset] = x1
+			if x1 > n {
+				k1end += 2
+			} else if y1 > m {
+				k1start += 2
+			} else if front {
+				k2Offset := vOffset + delta - k1
+				if k2Offset >= 0 && k2Offset < vLength && v2[k2Offset] != -1 {
+					if x1 >= n-v2[k2Offset] {
+						return x1, y1, true
+					}
+				}
+			}
+		}
+
+		for k2 := -step + k2start; k2 <= step-k2end; k2 += 2 {
+			k2Offset := vOffset + k2
+			var x2 int
+			if k2 == -step || (k2 != step && v2[k2Offset-1] < v2[k2Offset+1]) {
+				x2 = v2[k2Offset+1]
+			} else {
+				x2 = v2[k2Offset-1] + 1
+			}
+			y2 := x2 - k2
+			for x2 < n && y2 < m && a[n-x2-1] == b[m-y2-1] {
+				x2++
+				y2++
+			}
+			v2[k2Offset] = x2
+			if x2 > n {
+				k2end += 2
+			} else if y2 > m {
+				k2start += 2
+			} else if !front {
+				k1Offset := vOffset + delta - k2
+				if k1Offset >= 0 && k1Offset < vLength && v1[k1Offset] != -1 {
+					x1 := v1[k1Offset]
+					y1 := vOffset + x1 - k1Offset
+					if x1 >= n-x2 {
+						return x1, y1, true
+					}
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// patience anchors the diff on lines that occur exactly once in both ranges,
+// keeps the longest increasing run of those anchors and recurses between them.
+func (d *lineDiffer) patience(aLo, aHi, bLo, bHi int) {
+	if d.cancelled() {
+		return
+	}
+	aLo, aHi, bLo, bHi = d.trimCommon(aLo, aHi, bLo, bHi)
+
+	if aLo == aHi || bLo == bHi {
+		d.markRange(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	anchors := d.uniqueAnchors(aLo, aHi, bLo, bHi)
+	if len(anchors) == 0 {
+		d.myers(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	prevA, prevB := aLo, bLo
+	for _, anchor := range anchors {
+		d.patience(prevA, anchor[0], prevB, anchor[1])
+		prevA, prevB = anchor[0]+1, anchor[1]+1
+	}
+	d.patience(prevA, aHi, prevB, bHi)
+}
+
+// uniqueAnchors returns matching (a, b) index pairs of lines unique to both
+// ranges, filtered down to the longest sequence increasing on both sides.
+func (d *lineDiffer) uniqueAnchors(aLo, aHi, bLo, bHi int) [][2]int {
+	type occurrence struct {
+		countA, countB int
+		posA, posB     int
+	}
+
+	occurrences := make(map[int]*occurrence)
+	for i := aLo; i < aHi; i++ {
+		o := occurrences[d.a[i]]
+		if o == nil {
+			o = &occurrence{}
+			occurrences[d.a[i]] = o
+		}
+		o.countA++
+		o.posA = i
+	}
+	for j := bLo; j < bHi; j++ {
+		o := occurrences[d.b[j]]
+		if o == nil {
+			continue
+		}
+		o.countB++
+		o.posB = j
+	}
+
+	// Candidates in file1 order.
+	var candidates [][2]int
+	for i := aLo; i < aHi; i++ {
+		o := occurrences[d.a[i]]
+		if o.countA == 1 && o.countB == 1 {
+			candidates = append(candidates, [2]int{o.posA, o.posB})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Longest increasing subsequence on the file2 positions (patience sort).
+	tails := []int{}
+	prev := make([]int, len(candidates))
+	for idx, candidate := range candidates {
+		lo, hi := 0, len(tails)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if candidates[tails[mid]][1] < candidate[1] {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		if lo > 0 {
+			prev[idx] = tails[lo-1]
+		} else {
+			prev[idx] = -1
+		}
+		if lo == len(tails) {
+			tails = append(tails, idx)
+		} else {
+			tails[lo] = idx
+		}
+	}
+
+	anchors := make([][2]int, len(tails))
+	for idx, k := len(tails)-1, tails[len(tails)-1]; idx >= 0; idx, k = idx-1, prev[k] {
+		anchors[idx] = candidates[k]
+	}
+	return anchors
+}
@@ -0,0 +1,156 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var diffAlgorithms = []DiffAlgorithm{DiffAlgorithmMyers, DiffAlgorithmPatience}
+
+// diffCorpus holds tricky line diff inputs.
+var diffCorpus = []struct {
+	name   string
+	a, b   string
+	minLCS int // Length of the longest common subsequence of the lines.
+}{
+	{"both empty", "", "", 1},
+	{"empty left", "", "a\nb\nc", 0},
+	{"empty right", "a\nb\nc", "", 0},
+	{"identical", "a\nb\nc\n", "a\nb\nc\n", 4},
+	{"trailing newline added", "a\nb\nc", "a\nb\nc\n", 3},
+	{"trailing newline removed", "a\nb\nc\n", "a\nb\nc", 3},
+	{"blank lines only", "\n\n\n", "\n\n", 3},
+	{"prefix and suffix", "x\na\nb\ny", "x\nc\ny", 2},
+	{"nothing in common", "a\nb\nc", "d\ne\nf", 0},
+	{"moved block down", "A\nB\nC\nx\ny\nz", "x\ny\nz\nA\nB\nC", 3},
+	{"moved block up", "1\n2\n3\n4\nm1\nm2\n5", "m1\nm2\n1\n2\n3\n4\n5", 5},
+	{"swapped lines", "a\nb", "b\na", 1},
+	{"repeated lines", "a\na\na\nb\na", "a\nb\na\na\na", 4},
+	{"repeated braces", "f() {\n}\ng() {\n}\n", "g() {\n}\nh() {\n}\nf() {\n}\n", 3},
+	{"repeated inserted block", "x\ny", "x\ny\nx\ny\nx\ny", 2},
+	{"duplicate removed", "a\nb\nb\nb\nc", "a\nb\nc", 3},
+	{"interleaved", "a\n1\nb\n2\nc\n3", "1\na\n2\nb\n3\nc", 3},
+}
+
+// lcsLength is the brute-force length of the longest common subsequence.
+func lcsLength(a, b []string) int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else {
+				table[i][j] = max(table[i+1][j], table[i][j+1])
+			}
+		}
+	}
+	return table[0][0]
+}
+
+// checkDiff verifies that the unchanged lines of a and b form the same
+// sequence and returns its length.
+func checkDiff(t *testing.T, a, b []string, changedA, changedB []bool) int {
+	t.Helper()
+	if len(changedA) != len(a) || len(changedB) != len(b) {
+		t.Fatalf("changed flags have lengths %d and %d, want %d and %d", len(changedA), len(changedB), len(a), len(b))
+	}
+
+	var keptA, keptB []string
+	for i, line := range a {
+		if !changedA[i] {
+			keptA = append(keptA, line)
+		}
+	}
+	for j, line := range b {
+		if !changedB[j] {
+			keptB = append(keptB, line)
+		}
+	}
+	if !slices.Equal(keptA, keptB) {
+		t.Fatalf("unchanged lines differ:\n%q\n%q", keptA, keptB)
+	}
+	return len(keptA)
+}
+
+func TestDiffKeysCorpus(t *testing.T) {
+	for _, tt := range diffCorpus {
+		a, b := strings.Split(tt.a, "\n"), strings.Split(tt.b, "\n")
+		if got := lcsLength(a, b); got != tt.minLCS {
+			t.Fatalf("%s: corpus expects LCS %d, brute force finds %d", tt.name, tt.minLCS, got)
+		}
+		for _, algorithm := range diffAlgorithms {
+			t.Run(fmt.Sprintf("%s/%s", tt.name, algorithm), func(t *testing.T) {
+				changedA, changedB := diffKeys(a, b, algorithm)
+				common := checkDiff(t, a, b, changedA, changedB)
+				if algorithm == DiffAlgorithmMyers && common != tt.minLCS {
+					t.Errorf("myers keeps %d common lines, want the minimal diff keeping %d", common, tt.minLCS)
+				}
+			})
+		}
+	}
+}
+
+func TestDiffKeysRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(30))
+		alphabet := 1 + rng.Intn(6)
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(alphabet)))
+		}
+		return lines
+	}
+
+	for n := 0; n < 5000; n++ {
+		a, b := randomLines(), randomLines()
+		minLCS := lcsLength(a, b)
+		for _, algorithm := range diffAlgorithms {
+			changedA, changedB := diffKeys(a, b, algorithm)
+			common := checkDiff(t, a, b, changedA, changedB)
+			if algorithm == DiffAlgorithmMyers && common != minLCS {
+				t.Fatalf("myers keeps %d common lines of %q and %q, want %d", common, a, b, minLCS)
+			}
+		}
+	}
+}
+
+func TestPatienceAnchorsUniqueLines(t *testing.T) {
+	// The function headers are unique, so patience anchors on one of them
+	// and keeps the unmoved function whole.
+	a := strings.Split("func a() {\n\treturn 1\n}\nfunc b() {\n\treturn 2\n}", "\n")
+	b := strings.Split("func b() {\n\treturn 2\n}\nfunc a() {\n\treturn 1\n}", "\n")
+
+	changedA, changedB := diffKeys(a, b, DiffAlgorithmPatience)
+	checkDiff(t, a, b, changedA, changedB)
+	if changedA[0] == changedA[3] {
+		t.Errorf("patience should keep exactly one of the function headers, changed = %v", changedA)
+	}
+	for i := 0; i < 3; i++ {
+		if changedA[i] != changedA[0] || changedA[i+3] != changedA[3] {
+			t.Errorf("patience split a function body, changed = %v", changedA)
+		}
+	}
+}
+
+func TestDiffKeysContextCancelled(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	a, b := make([]string, 5000), make([]string, 5000)
+	for i := range a {
+		a[i], b[i] = fmt.Sprint(rng.Intn(2)), fmt.Sprint(rng.Intn(2))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, algorithm := range diffAlgorithms {
+		if _, _, err := diffKeysContext(ctx, a, b, algorithm); err != context.Canceled {
+			t.Errorf("%s: got error %v, want %v", algorithm, err, context.Canceled)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	diffDefaultContext = 3
+	diffMaxContext     = 10000
+
+	diffLinesMaxCount = 100000
+)
+
+// DiffHunk is one block of a hunked diff, like a hunk of `diff -U n`: either
+// changed lines with up to n equal lines of context around them, or a
+// collapsed run of equal lines whose Lines are omitted. Offset and Count
+// locate the block in the full list of diff lines, so a collapsed run can be
+// expanded on demand. A side with no lines starts at the line before the
+// block, as in unified diffs.
+type DiffHunk struct {
+	Header    string     `json:"header,omitempty"` // "@@ -old +new @@"; empty for collapsed runs.
+	OldStart  int        `json:"old_start"`
+	OldLines  int        `json:"old_lines"`
+	NewStart  int        `json:"new_start"`
+	NewLines  int        `json:"new_lines"`
+	Offset    int        `json:"offset"`
+	Count     int        `json:"count"`
+	Collapsed bool       `json:"collapsed,omitempty"`
+	Lines     []DiffLine `json:"lines,omitempty"`
+}
+
+// parseDiffContext reads the context parameter and reports whether it was set.
+func parseDiffContext(c *gin.Context) (int, bool, error) {
+	raw := c.Query("context")
+	if raw == "" {
+		return diffDefaultContext, false, nil
+	}
+	contextLines, err := strconv.Atoi(raw)
+	if err != nil || contextLines < 0 || contextLines > diffMaxContext {
+		return 0, false, fmt.Errorf("invalid context %q, expected 0 to %d", raw, diffMaxContext)
+	}
+	return contextLines, true, nil
+}
+
+// buildDiffHunks groups the diff lines into hunks with the given number of
+// context lines, collapsing the unchanged runs between them. Hunks whose
+// context would touch are merged.
+func buildDiffHunks(diffLines []DiffLine, contextLines int) []DiffHunk {
+	// Ranges [start, end) of diff lines shown in hunks.
+	var ranges [][2]int
+	for i, line := range diffLines {
+		if line.Type == "equal" {
+			continue
+		}
+		start, end := max(i-contextLines, 0), min(i+contextLines+1, len(diffLines))
+		if n := len(ranges); n > 0 && start <= ranges[n-1][1] {
+			ranges[n-1][1] = end
+		} else {
+			ranges = append(ranges, [2]int{start, end})
+		}
+	}
+
+	hunks := []DiffHunk{}
+	oldLine, newLine := 0, 0 // Last line numbers seen on each side.
+	block := func(start, end int, collapsed bool) {
+		hunk := DiffHunk{Offset: start, Count: end - start, Collapsed: collapsed}
+		hunk.OldStart, hunk.NewStart = oldLine, newLine
+		for _, line := range diffLines[start:end] {
+			if line.LineNum1 > 0 {
+				if hunk.OldLines == 0 {
+					hunk.OldStart = line.LineNum1
+				}
+				hunk.OldLines++
+				oldLine = line.LineNum1
+			}
+			if line.LineNum2 > 0 {
+				if hunk.NewLines == 0 {
+					hunk.NewStart = line.LineNum2
+				}
+				hunk.NewLines++
+				newLine = line.LineNum2
+			}
+		}
+		if !collapsed {
+			hunk.Header = fmt.Sprintf("@@ -%s +%s @@", formatHunkRange(hunk.OldStart, hunk.OldLines), formatHunkRange(hunk.NewStart, hunk.NewLines))
+			hunk.Lines = diffLines[start:end]
+		}
+		hunks = append(hunks, hunk)
+	}
+
+	pos := 0
+	for _, r := range ranges {
+		if r[0] > pos {
+			block(pos, r[0], true)
+		}
+		block(r[0], r[1], false)
+		pos = r[1]
+	}
+	if pos < len(diffLines) {
+		block(pos, len(diffLines), true)
+	}
+
+	return hunks
+}
+
+// formatHunkRange formats one side of a hunk header; the count is omitted
+// when it is 1, as GNU diff does.
+func formatHunkRange(start, count int) string {
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// parseDiffLinesRange reads the offset and count parameters used to expand a
+// collapsed run of diff lines.
+func parseDiffLinesRange(c *gin.Context) (int, int, error) {
+	offset, err := strconv.Atoi(c.Query("offset"))
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid offset %q", c.Query("offset"))
+	}
+	count, err := strconv.Atoi(c.Query("count"))
+	if err != nil || count < 1 || count > diffLinesMaxCount {
+		return 0, 0, fmt.Errorf("invalid count %q, expected 1 to %d", c.Query("count"), diffLinesMaxCount)
+	}
+	return offset, count, nil
+}
+
+// sliceDiffLines returns up to count diff lines starting at offset.
+func sliceDiffLines(diffLines []DiffLine, offset, count int) []DiffLine {
+	if offset >= len(diffLines) {
+		return []DiffLine{}
+	}
+	return diffLines[offset:min(offset+count, len(diffLines))]
+}
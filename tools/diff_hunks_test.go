@@ -0,0 +1,311 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFormatHunkRange(t *testing.T) {
+	tests := []struct {
+		start, count int
+		want         string
+	}{
+		{1, 1, "1"},
+		{7, 1, "7"},
+		{3, 2, "3,2"},
+		{0, 0, "0,0"},
+		{5, 0, "5,0"},
+	}
+	for _, tt := range tests {
+		if got := formatHunkRange(tt.start, tt.count); got != tt.want {
+			t.Errorf("formatHunkRange(%d, %d) = %q, want %q", tt.start, tt.count, got, tt.want)
+		}
+	}
+}
+
+// hunkLayout describes a hunk as "@@ header @@ offset+count" or, for a
+// collapsed run, "collapsed offset+count".
+func hunkLayout(hunks []DiffHunk) []string {
+	layout := []string{}
+	for _, hunk := range hunks {
+		if hunk.Collapsed {
+			layout = append(layout, fmt.Sprintf("collapsed %d+%d", hunk.Offset, hunk.Count))
+		} else {
+			layout = append(layout, fmt.Sprintf("%s %d+%d", hunk.Header, hunk.Offset, hunk.Count))
+		}
+	}
+	return layout
+}
+
+// letterLines returns the lines "a", "b", ... of length n.
+func letterLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = string(rune('a' + i))
+	}
+	return lines
+}
+
+// withLines returns a copy of lines with the given lines replaced.
+func withLines(lines []string, replace map[int]string) []string {
+	result := append([]string(nil), lines...)
+	for i, line := range replace {
+		result[i] = line
+	}
+	return result
+}
+
+func TestBuildDiffHunks(t *testing.T) {
+	tests := []struct {
+		name         string
+		lines1       []string
+		lines2       []string
+		contextLines int
+		want         []string
+	}{
+		{
+			name:         "identical",
+			lines1:       letterLines(5),
+			lines2:       letterLines(5),
+			contextLines: 3,
+			want:         []string{"collapsed 0+5"},
+		},
+		{
+			name:         "empty",
+			lines1:       []string{},
+			lines2:       []string{},
+			contextLines: 3,
+			want:         []string{},
+		},
+		{
+			name:         "change in the middle",
+			lines1:       letterLines(10),
+			lines2:       withLines(letterLines(10), map[int]string{5: "X"}),
+			contextLines: 2,
+			want:         []string{"collapsed 0+3", "@@ -4,5 +4,5 @@ 3+5", "collapsed 8+2"},
+		},
+		{
+			name:         "single line hunk",
+			lines1:       letterLines(5),
+			lines2:       withLines(letterLines(5), map[int]string{2: "X"}),
+			contextLines: 0,
+			want:         []string{"collapsed 0+2", "@@ -3 +3 @@ 2+1", "collapsed 3+2"},
+		},
+		{
+			name:         "insertion at the start",
+			lines1:       []string{"a", "b"},
+			lines2:       []string{"x", "a", "b"},
+			contextLines: 0,
+			want:         []string{"@@ -0,0 +1 @@ 0+1", "collapsed 1+2"},
+		},
+		{
+			name:         "insertion in the middle",
+			lines1:       []string{"a", "b"},
+			lines2:       []string{"a", "x", "y", "b"},
+			contextLines: 0,
+			want:         []string{"collapsed 0+1", "@@ -1,0 +2,2 @@ 1+2", "collapsed 3+1"},
+		},
+		{
+			name:         "deletion in the middle",
+			lines1:       []string{"a", "b", "c"},
+			lines2:       []string{"a", "c"},
+			contextLines: 0,
+			want:         []string{"collapsed 0+1", "@@ -2 +1,0 @@ 1+1", "collapsed 2+1"},
+		},
+		{
+			name:         "everything deleted",
+			lines1:       []string{"a", "b"},
+			lines2:       []string{},
+			contextLines: 3,
+			want:         []string{"@@ -1,2 +0,0 @@ 0+2"},
+		},
+		{
+			name:         "context clipped at both ends",
+			lines1:       letterLines(3),
+			lines2:       withLines(letterLines(3), map[int]string{1: "X"}),
+			contextLines: 5,
+			want:         []string{"@@ -1,3 +1,3 @@ 0+3"},
+		},
+		{
+			// Four equal lines between the changes: two lines of context on
+			// each side touch, so the hunks merge.
+			name:         "touching context merges",
+			lines1:       letterLines(12),
+			lines2:       withLines(letterLines(12), map[int]string{2: "X", 7: "Y"}),
+			contextLines: 2,
+			want:         []string{"@@ -1,10 +1,10 @@ 0+10", "collapsed 10+2"},
+		},
+		{
+			name:         "overlapping context merges",
+			lines1:       letterLines(12),
+			lines2:       withLines(letterLines(12), map[int]string{2: "X", 5: "Y"}),
+			contextLines: 2,
+			want:         []string{"@@ -1,8 +1,8 @@ 0+8", "collapsed 8+4"},
+		},
+		{
+			name:         "separate hunks",
+			lines1:       letterLines(12),
+			lines2:       withLines(letterLines(12), map[int]string{2: "X", 7: "Y"}),
+			contextLines: 1,
+			want:         []string{"collapsed 0+1", "@@ -2,3 +2,3 @@ 1+3", "collapsed 4+2", "@@ -7,3 +7,3 @@ 6+3", "collapsed 9+3"},
+		},
+		{
+			name:         "separate hunks without context",
+			lines1:       letterLines(6),
+			lines2:       withLines(letterLines(6), map[int]string{1: "X", 3: "Y"}),
+			contextLines: 0,
+			want:         []string{"collapsed 0+1", "@@ -2 +2 @@ 1+1", "collapsed 2+1", "@@ -4 +4 @@ 3+1", "collapsed 4+2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffLines, _ := generateLineByLineDiff(tt.lines1, tt.lines2, CompareOptions{})
+			hunks := buildDiffHunks(diffLines, tt.contextLines)
+			if got := hunkLayout(hunks); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("hunks = %q, want %q", got, tt.want)
+			}
+			checkHunksCover(t, hunks, diffLines)
+		})
+	}
+}
+
+// checkHunksCover checks that the hunks tile the diff lines, that collapsed
+// runs expand to equal lines through sliceDiffLines, and that the line
+// ranges of every block match its lines.
+func checkHunksCover(t *testing.T, hunks []DiffHunk, diffLines []DiffLine) {
+	t.Helper()
+	offset := 0
+	for _, hunk := range hunks {
+		if hunk.Offset != offset {
+			t.Fatalf("block at offset %d, want %d", hunk.Offset, offset)
+		}
+		lines := hunk.Lines
+		if hunk.Collapsed {
+			if hunk.Lines != nil {
+				t.Errorf("collapsed block at %d carries lines", hunk.Offset)
+			}
+			lines = sliceDiffLines(diffLines, hunk.Offset, hunk.Count)
+			for _, line := range lines {
+				if line.Type != "equal" {
+					t.Errorf("collapsed block at %d holds a %s line", hunk.Offset, line.Type)
+				}
+			}
+		}
+		if !reflect.DeepEqual(lines, diffLines[hunk.Offset:hunk.Offset+hunk.Count]) {
+			t.Errorf("block at %d does not match diff lines %d to %d", hunk.Offset, hunk.Offset, hunk.Offset+hunk.Count)
+		}
+
+		oldLines, newLines := 0, 0
+		for _, line := range lines {
+			if line.LineNum1 > 0 {
+				if oldLines == 0 && line.LineNum1 != hunk.OldStart {
+					t.Errorf("block at %d: old side starts at %d, header says %d", hunk.Offset, line.LineNum1, hunk.OldStart)
+				}
+				oldLines++
+			}
+			if line.LineNum2 > 0 {
+				if newLines == 0 && line.LineNum2 != hunk.NewStart {
+					t.Errorf("block at %d: new side starts at %d, header says %d", hunk.Offset, line.LineNum2, hunk.NewStart)
+				}
+				newLines++
+			}
+		}
+		if oldLines != hunk.OldLines || newLines != hunk.NewLines {
+			t.Errorf("block at %d has %d old and %d new lines, header says %d and %d", hunk.Offset, oldLines, newLines, hunk.OldLines, hunk.NewLines)
+		}
+		offset += hunk.Count
+	}
+	if offset != len(diffLines) {
+		t.Errorf("blocks cover %d of %d diff lines", offset, len(diffLines))
+	}
+}
+
+func TestSliceDiffLines(t *testing.T) {
+	diffLines, _ := generateLineByLineDiff(letterLines(5), letterLines(5), CompareOptions{})
+	tests := []struct {
+		offset, count int
+		want          int
+	}{
+		{0, 5, 5},
+		{1, 2, 2},
+		{3, 10, 2},
+		{5, 1, 0},
+		{9, 1, 0},
+	}
+	for _, tt := range tests {
+		got := sliceDiffLines(diffLines, tt.offset, tt.count)
+		if got == nil || len(got) != tt.want {
+			t.Errorf("sliceDiffLines(%d, %d) returned %d lines, want %d", tt.offset, tt.count, len(got), tt.want)
+			continue
+		}
+		if tt.want > 0 && got[0].LineNum1 != tt.offset+1 {
+			t.Errorf("sliceDiffLines(%d, %d) starts at line %d", tt.offset, tt.count, got[0].LineNum1)
+		}
+	}
+}
+
+func TestHandleFileCompareCollapsedLines(t *testing.T) {
+	useTestUploads(t)
+	lines1 := make([]string, 60)
+	for i := range lines1 {
+		lines1[i] = fmt.Sprintf("Measure_%d=%d", i, i)
+	}
+	lines2 := withLines(lines1, map[int]string{10: "Measure_10=11", 40: "Measure_40=41"})
+	lines2 = append(lines2[:50], lines2[51:]...)
+	content1, content2 := strings.Join(lines1, "\n")+"\n", strings.Join(lines2, "\n")+"\n"
+	file1 := registerTestUpload(t, uploadKindFileCompare, "baby.txt", content1)
+	file2 := registerTestUpload(t, uploadKindFileCompare, "candy.txt", content2)
+	query := fmt.Sprintf("file1=%s&file2=%s&ignore_case=true", file1, file2)
+
+	w := serveTestRequest(HandleFileCompare, "/api/file-compare/compare?context=2&"+query)
+	if w.Code != http.StatusOK {
+		t.Fatalf("compare: status %d: %s", w.Code, w.Body.String())
+	}
+	var result FileCompareResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.DiffLines) != 0 {
+		t.Errorf("hunked result carries %d diff lines", len(result.DiffLines))
+	}
+
+	// Expanding every collapsed run through /lines rebuilds the full diff.
+	var expanded []DiffLine
+	collapsed := 0
+	for _, hunk := range result.Hunks {
+		if !hunk.Collapsed {
+			expanded = append(expanded, hunk.Lines...)
+			continue
+		}
+		collapsed++
+		w := serveTestRequest(HandleFileCompareLines, fmt.Sprintf("/api/file-compare/lines?offset=%d&count=%d&%s", hunk.Offset, hunk.Count, query))
+		if w.Code != http.StatusOK {
+			t.Fatalf("lines: status %d: %s", w.Code, w.Body.String())
+		}
+		var page struct {
+			Offset int        `json:"offset"`
+			Lines  []DiffLine `json:"lines"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Offset != hunk.Offset || len(page.Lines) != hunk.Count {
+			t.Fatalf("lines at %d returned %d lines from %d, want %d", hunk.Offset, len(page.Lines), page.Offset, hunk.Count)
+		}
+		expanded = append(expanded, page.Lines...)
+	}
+	if collapsed != 4 {
+		t.Errorf("got %d collapsed runs, want 4", collapsed)
+	}
+
+	opts := CompareOptions{IgnoreCase: true}
+	want, _ := generateLineByLineDiff(strings.Split(content1, "\n"), strings.Split(content2, "\n"), opts)
+	if !reflect.DeepEqual(expanded, want) {
+		t.Errorf("expanded diff does not match the full diff")
+	}
+}
@@ -13,14 +13,19 @@ import (
 )
 
 type FileCompareResult struct {
-	File1Name    string     `json:"file1_name"`
-	File2Name    string     `json:"file2_name"`
-	File1Content string     `json:"file1_content"`
-	File2Content string     `json:"file2_content"`
-	DiffHTML     string     `json:"diff_html"`
-	Lines1       []string   `json:"lines1"`
-	Lines2       []string   `json:"lines2"`
-	DiffLines    []DiffLine `json:"diff_lines"`
+	File1Name    string           `json:"file1_name"`
+	File2Name    string           `json:"file2_name"`
+	File1Content string           `json:"file1_content"`
+	File2Content string           `json:"file2_content"`
+	DiffHTML     string           `json:"diff_html"`
+	Lines1       []string         `json:"lines1"`
+	Lines2       []string         `json:"lines2"`
+	DiffLines    []DiffLine       `json:"diff_lines"`      // Empty when hunks are requested.
+	Hunks        []DiffHunk       `json:"hunks,omitempty"` // Set when the context parameter is given.
+	Numeric      *NumericSummary  `json:"numeric_summary,omitempty"`
+	Mode         string           `json:"mode"`              // "text" or "semantic"
+	Formats      []string         `json:"formats,omitempty"` // Document formats in semantic mode.
+	Changes      []SemanticChange `json:"changes,omitempty"` // Path-addressed changes in semantic mode.
 }
 
 func HandleFileCompareUpload(c *gin.Context) {
@@ -45,7 +50,7 @@ func HandleFileCompareUpload(c *gin.Context) {
 	}
 
 	// Save files to disk.
-	var savedFiles []string
+	var fileIDs []string
 	for i, file := range files {
 		// Generate unique file name.
 		timestamp := time.Now().UnixNano()
@@ -56,37 +61,104 @@ func HandleFileCompareUpload(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
 			return
 		}
-		savedFiles = append(savedFiles, filepath)
+
+		id, err := uploads.Register(uploadKindFileCompare, filepath, file.Filename)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register upload"})
+			return
+		}
+		fileIDs = append(fileIDs, id)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "files uploaded successfully",
-		"files":   savedFiles,
+		"files":   fileIDs,
 	})
 }
 
+// resolveFileComparePair resolves the file1 and file2 upload IDs. On failure
+// it writes the error response and returns false.
+func resolveFileComparePair(c *gin.Context) (uploadEntry, uploadEntry, bool) {
+	file1ID := c.Query("file1")
+	file2ID := c.Query("file2")
+
+	if file1ID == "" || file2ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file parameter"})
+		return uploadEntry{}, uploadEntry{}, false
+	}
+
+	file1, ok1 := uploads.Resolve(file1ID, uploadKindFileCompare)
+	file2, ok2 := uploads.Resolve(file2ID, uploadKindFileCompare)
+	if !ok1 || !ok2 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return uploadEntry{}, uploadEntry{}, false
+	}
+	return file1, file2, true
+}
+
 func HandleFileCompare(c *gin.Context) {
-	file1Path := c.Query("file1")
-	file2Path := c.Query("file2")
+	file1, file2, ok := resolveFileComparePair(c)
+	if !ok {
+		return
+	}
 
-	if file1Path == "" || file2Path == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file path parameter"})
+	opts, err := parseCompareOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contextLines, hunked, err := parseDiffContext(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	mode := c.DefaultQuery("mode", fileCompareModeText)
+	if mode != fileCompareModeText && mode != fileCompareModeSemantic {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported mode: " + mode})
+		return
+	}
+	semantic, err := parseSemanticOptions(c, opts)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Read file content.
-	content1, err := readFileContent(file1Path)
+	content1, err := readFileContent(file1.Path)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file1: " + err.Error()})
 		return
 	}
 
-	content2, err := readFileContent(file2Path)
+	content2, err := readFileContent(file2.Path)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file2: " + err.Error()})
 		return
 	}
 
+	if mode == fileCompareModeSemantic {
+		changes, formats, err := compareDocuments(file1.Name, content1, file2.Name, content2, semantic)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, FileCompareResult{
+			File1Name:    file1.Name,
+			File2Name:    file2.Name,
+			File1Content: content1,
+			File2Content: content2,
+			Lines1:       strings.Split(content1, "\n"),
+			Lines2:       strings.Split(content2, "\n"),
+			DiffLines:    []DiffLine{},
+			Mode:         mode,
+			Formats:      formats[:],
+			Changes:      changes,
+		})
+		return
+	}
+
 	// Generate diff.
 	dmp := diffmatchpatch.New()
 	diffs := dmp.DiffMain(content1, content2, true)
@@ -97,18 +169,65 @@ func HandleFileCompare(c *gin.Context) {
 	// Generate line-by-line comparison.
 	lines1 := strings.Split(content1, "\n")
 	lines2 := strings.Split(content2, "\n")
-	diffLines := generateLineByLineDiff(lines1, lines2)
+	diffLines, numeric := generateLineByLineDiff(lines1, lines2, opts)
 
 	result := FileCompareResult{
-		File1Name:    filepath.Base(file1Path),
-		File2Name:    filepath.Base(file2Path),
+		File1Name:    file1.Name,
+		File2Name:    file2.Name,
 		File1Content: content1,
 		File2Content: content2,
 		DiffHTML:     diffHTML,
 		Lines1:       lines1,
 		Lines2:       lines2,
 		DiffLines:    diffLines,
+		Numeric:      numeric,
+		Mode:         mode,
+	}
+	if hunked {
+		result.Hunks = buildDiffHunks(diffLines, contextLines)
+		result.DiffLines = []DiffLine{}
 	}
 
 	c.JSON(http.StatusOK, result)
 }
+
+// HandleFileCompareLines returns a window of the full line-by-line diff, used
+// to expand the unchanged runs collapsed between hunks.
+func HandleFileCompareLines(c *gin.Context) {
+	file1, file2, ok := resolveFileComparePair(c)
+	if !ok {
+		return
+	}
+
+	opts, err := parseCompareOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	offset, count, err := parseDiffLinesRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	content1, err := readFileContent(file1.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file1: " + err.Error()})
+		return
+	}
+
+	content2, err := readFileContent(file2.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file2: " + err.Error()})
+		return
+	}
+
+	diffLines, _ := generateLineByLineDiff(strings.Split(content1, "\n"), strings.Split(content2, "\n"), opts)
+
+	c.JSON(http.StatusOK, gin.H{
+		"offset": offset,
+		"total":  len(diffLines),
+		"lines":  sliceDiffLines(diffLines, offset, count),
+	})
+}
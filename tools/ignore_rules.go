@@ -0,0 +1,122 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ignoreRulesFile = "config/ignore_rules.json"
+
+// Ignore rule actions.
+const (
+	// IgnoreRuleActionLine excludes matching lines from the comparison.
+	IgnoreRuleActionLine = "ignore_line"
+	// IgnoreRuleActionMask replaces matching text before lines are compared.
+	IgnoreRuleActionMask = "mask"
+)
+
+// IgnoreRule describes volatile content such as timestamps or run IDs.
+type IgnoreRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`            // "ignore_line" or "mask"
+	Replace string `json:"replace,omitempty"` // Replacement text for "mask" rules.
+
+	re *regexp.Regexp
+}
+
+// IgnoreRuleSet is a named group of ignore rules selectable per request.
+type IgnoreRuleSet struct {
+	Name  string       `json:"name"`
+	Rules []IgnoreRule `json:"rules"`
+}
+
+var ignoreRules = &configStore[IgnoreRuleSet]{
+	path:    ignoreRulesFile,
+	name:    func(s IgnoreRuleSet) string { return s.Name },
+	compile: (*IgnoreRuleSet).compile,
+}
+
+// compile validates the rule set and compiles its patterns.
+func (s *IgnoreRuleSet) compile() error {
+	if s.Name == "" {
+		return errors.New("rule set name is required")
+	}
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+		if rule.Action == "" {
+			rule.Action = IgnoreRuleActionLine
+		}
+		if rule.Action != IgnoreRuleActionLine && rule.Action != IgnoreRuleActionMask {
+			return fmt.Errorf("rule %q: unsupported action %q", rule.Name, rule.Action)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %q: invalid pattern: %v", rule.Name, err)
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// lookupIgnoreRuleSet returns the named rule set.
+func lookupIgnoreRuleSet(name string) (IgnoreRuleSet, error) {
+	set, ok, err := ignoreRules.Get(name)
+	if err != nil {
+		return IgnoreRuleSet{}, err
+	}
+	if !ok {
+		return IgnoreRuleSet{}, fmt.Errorf("unknown ignore rule set %q", name)
+	}
+	return set, nil
+}
+
+func HandleIgnoreRulesList(c *gin.Context) {
+	sets, err := ignoreRules.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load ignore rules: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rule_sets": sets})
+}
+
+func HandleIgnoreRulesSave(c *gin.Context) {
+	var set IgnoreRuleSet
+	if err := c.ShouldBindJSON(&set); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule set: " + err.Error()})
+		return
+	}
+	if err := set.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ignoreRules.Put(set); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save ignore rules: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "rule set saved successfully",
+		"rule_set": set,
+	})
+}
+
+func HandleIgnoreRulesDelete(c *gin.Context) {
+	deleted, err := ignoreRules.Delete(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save ignore rules: " + err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule set not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "rule set deleted successfully"})
+}
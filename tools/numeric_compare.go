@@ -0,0 +1,79 @@
+package tools
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// numberPattern matches integer, decimal and scientific notation tokens.
+var numberPattern = regexp.MustCompile(`[-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?`)
+
+// numberMask replaces numeric tokens in line keys so lines that only differ
+// in their numbers are aligned and then checked against the tolerances.
+const numberMask = "\x00"
+
+// NumericSummary reports the numeric deviations found by a tolerance comparison.
+type NumericSummary struct {
+	AbsTolerance     float64 `json:"abs_tolerance"`
+	RelTolerance     float64 `json:"rel_tolerance"`
+	ComparedValues   int     `json:"compared_values"`
+	Breaks           int     `json:"breaks"` // Lines with at least one value outside tolerance.
+	MaxAbsDeviation  float64 `json:"max_abs_deviation"`
+	MaxRelDeviation  float64 `json:"max_rel_deviation"`
+	MaxDeviationLine int     `json:"max_deviation_line"` // Line in file1 holding MaxAbsDeviation.
+}
+
+// maskNumbers replaces every numeric token with numberMask.
+func maskNumbers(line string) string {
+	return numberPattern.ReplaceAllString(line, numberMask)
+}
+
+// compareNumbers checks the numeric tokens of two aligned lines and records
+// their deviations. It returns false when any value breaks the tolerances.
+func (s *NumericSummary) compareNumbers(line1, line2 string, lineNum int) bool {
+	tokens1 := numberPattern.FindAllString(line1, -1)
+	tokens2 := numberPattern.FindAllString(line2, -1)
+	if len(tokens1) != len(tokens2) {
+		return false
+	}
+
+	withinTolerance := true
+	for k := range tokens1 {
+		if tokens1[k] == tokens2[k] {
+			s.ComparedValues++
+			continue
+		}
+
+		value1, err1 := strconv.ParseFloat(tokens1[k], 64)
+		value2, err2 := strconv.ParseFloat(tokens2[k], 64)
+		if err1 != nil || err2 != nil {
+			withinTolerance = false
+			continue
+		}
+		s.ComparedValues++
+
+		absDiff := math.Abs(value1 - value2)
+		relDiff := 0.0
+		if scale := math.Max(math.Abs(value1), math.Abs(value2)); scale > 0 {
+			relDiff = absDiff / scale
+		}
+
+		if absDiff > s.MaxAbsDeviation {
+			s.MaxAbsDeviation = absDiff
+			s.MaxDeviationLine = lineNum
+		}
+		if relDiff > s.MaxRelDeviation {
+			s.MaxRelDeviation = relDiff
+		}
+
+		if absDiff > s.AbsTolerance && relDiff > s.RelTolerance {
+			withinTolerance = false
+		}
+	}
+
+	if !withinTolerance {
+		s.Breaks++
+	}
+	return withinTolerance
+}
@@ -0,0 +1,184 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	pairingRulesFile = "config/pairing_rules.json"
+
+	// defaultPairingRule pairs babyy-risk-{id}.txt with candyy-risk-{id}.txt.
+	defaultPairingRule = "default"
+)
+
+// PairingRule describes how the two sides of a comparison are named inside
+// an archive. Both patterns must capture the shared ID, either in the group
+// named by IDGroup (a name or index, default "id") or in the first group.
+type PairingRule struct {
+	Name         string `json:"name"`
+	LeftPattern  string `json:"left_pattern"`
+	RightPattern string `json:"right_pattern"`
+	IDGroup      string `json:"id_group,omitempty"`
+	LeftLabel    string `json:"left_label"`
+	RightLabel   string `json:"right_label"`
+	RiskFormat   string `json:"risk_format,omitempty"` // Default risk format for comparisons.
+
+	left, right *regexp.Regexp
+}
+
+var pairingRules = &configStore[PairingRule]{
+	path:    pairingRulesFile,
+	name:    func(r PairingRule) string { return r.Name },
+	compile: (*PairingRule).compile,
+	defaults: []PairingRule{{
+		Name:         defaultPairingRule,
+		LeftPattern:  `^babyy-risk-(?P<id>.+)\.txt$`,
+		RightPattern: `^candyy-risk-(?P<id>.+)\.txt$`,
+		LeftLabel:    "baby",
+		RightLabel:   "candy",
+	}},
+}
+
+// compile validates the rule and compiles its patterns.
+func (r *PairingRule) compile() error {
+	if r.Name == "" {
+		return errors.New("pairing rule name is required")
+	}
+	if r.LeftLabel == "" {
+		r.LeftLabel = "left"
+	}
+	if r.RightLabel == "" {
+		r.RightLabel = "right"
+	}
+	if r.LeftLabel == r.RightLabel {
+		return errors.New("left and right labels must differ")
+	}
+
+	var err error
+	if r.left, err = compilePairingPattern(r.LeftPattern, r.IDGroup); err != nil {
+		return fmt.Errorf("invalid left pattern: %v", err)
+	}
+	if r.right, err = compilePairingPattern(r.RightPattern, r.IDGroup); err != nil {
+		return fmt.Errorf("invalid right pattern: %v", err)
+	}
+	return nil
+}
+
+// compilePairingPattern compiles a file name pattern and checks that it has
+// the capture group holding the ID.
+func compilePairingPattern(pattern, idGroup string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.NumSubexp() == 0 {
+		return nil, errors.New("pattern must contain a capture group for the ID")
+	}
+	if idGroup != "" && captureIndex(re, idGroup) < 0 {
+		return nil, fmt.Errorf("pattern has no capture group %q", idGroup)
+	}
+	return re, nil
+}
+
+// captureIndex resolves a capture group name or index.
+func captureIndex(re *regexp.Regexp, group string) int {
+	if group == "" {
+		group = "id"
+	}
+	if index := re.SubexpIndex(group); index >= 0 {
+		return index
+	}
+	if index, err := strconv.Atoi(group); err == nil && index >= 1 && index <= re.NumSubexp() {
+		return index
+	}
+	if group == "id" {
+		return 1
+	}
+	return -1
+}
+
+// match returns the ID and side label for a file name, or empty strings when
+// the name matches neither side.
+func (r PairingRule) match(fileName string) (string, string) {
+	if m := r.left.FindStringSubmatch(fileName); m != nil {
+		return m[captureIndex(r.left, r.IDGroup)], r.LeftLabel
+	}
+	if m := r.right.FindStringSubmatch(fileName); m != nil {
+		return m[captureIndex(r.right, r.IDGroup)], r.RightLabel
+	}
+	return "", ""
+}
+
+// lookupPairingRule returns the named pairing rule, or the default rule when
+// name is empty.
+func lookupPairingRule(name string) (PairingRule, error) {
+	if name == "" {
+		name = defaultPairingRule
+	}
+	rule, ok, err := pairingRules.Get(name)
+	if err != nil {
+		return PairingRule{}, err
+	}
+	if !ok {
+		return PairingRule{}, fmt.Errorf("unknown pairing rule %q", name)
+	}
+	return rule, nil
+}
+
+func HandlePairingRulesList(c *gin.Context) {
+	rules, err := pairingRules.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load pairing rules: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pairing_rules": rules})
+}
+
+func HandlePairingRulesSave(c *gin.Context) {
+	var rule PairingRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pairing rule: " + err.Error()})
+		return
+	}
+	if err := rule.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := pairingRules.Put(rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save pairing rules: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "pairing rule saved successfully",
+		"pairing_rule": rule,
+	})
+}
+
+func HandlePairingRulesDelete(c *gin.Context) {
+	name := c.Param("name")
+	if name == defaultPairingRule {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the default pairing rule cannot be deleted"})
+		return
+	}
+
+	deleted, err := pairingRules.Delete(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save pairing rules: " + err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pairing rule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "pairing rule deleted successfully"})
+}
@@ -0,0 +1,238 @@
+package tools
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const noNewlineMarker = "\\ No newline at end of file\n"
+
+// patchSide describes the real lines of one side of a comparison. Splitting
+// content that ends with a newline leaves a phantom empty last element.
+type patchSide struct {
+	lines     int  // Number of real lines.
+	noNewline bool // The last real line has no trailing newline.
+}
+
+func newPatchSide(content string) patchSide {
+	lines := strings.Count(content, "\n")
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		return patchSide{lines: lines + 1, noNewline: true}
+	}
+	return patchSide{lines: lines}
+}
+
+// isLast reports whether line n is the last line and lacks a newline.
+func (s patchSide) isLast(n int) bool {
+	return s.noNewline && n == s.lines
+}
+
+// patchLines turns a line-by-line diff into an exact edit script: equal
+// lines whose raw text differs (ignore rules, tolerances) become a deletion
+// and an insertion, phantom lines are dropped, and the changes of every run
+// list deletions before insertions.
+func patchLines(diffLines []DiffLine, left, right patchSide) []DiffLine {
+	var result, deletes, inserts []DiffLine
+	flush := func() {
+		result = append(result, deletes...)
+		result = append(result, inserts...)
+		deletes, inserts = deletes[:0], inserts[:0]
+	}
+	deleteLine := func(line DiffLine) {
+		if line.LineNum1 > 0 && line.LineNum1 <= left.lines {
+			deletes = append(deletes, DiffLine{Type: "delete", Line1: line.Line1, LineNum1: line.LineNum1})
+		}
+	}
+	insertLine := func(line DiffLine) {
+		if line.LineNum2 > 0 && line.LineNum2 <= right.lines {
+			inserts = append(inserts, DiffLine{Type: "insert", Line2: line.Line2, LineNum2: line.LineNum2})
+		}
+	}
+
+	for _, line := range diffLines {
+		real1 := line.LineNum1 > 0 && line.LineNum1 <= left.lines
+		real2 := line.LineNum2 > 0 && line.LineNum2 <= right.lines
+		if line.Type == "equal" && real1 && real2 && line.Line1 == line.Line2 &&
+			left.isLast(line.LineNum1) == right.isLast(line.LineNum2) {
+			flush()
+			result = append(result, line)
+			continue
+		}
+		deleteLine(line)
+		insertLine(line)
+	}
+	flush()
+
+	return result
+}
+
+// writeUnifiedDiff appends a GNU unified diff of one file to b. Both headers
+// name path, so the patch applies to the old side's tree with -p1. Nothing is
+// written when the contents are equal.
+func writeUnifiedDiff(b *strings.Builder, path, content1, content2 string, diffLines []DiffLine, contextLines int) {
+	if content1 == content2 {
+		return
+	}
+	left, right := newPatchSide(content1), newPatchSide(content2)
+	lines := patchLines(diffLines, left, right)
+
+	fmt.Fprintf(b, "--- a/%s\n+++ b/%s\n", path, path)
+	for _, hunk := range buildDiffHunks(lines, contextLines) {
+		if hunk.Collapsed {
+			continue
+		}
+		b.WriteString(hunk.Header + "\n")
+		for _, line := range hunk.Lines {
+			switch line.Type {
+			case "equal":
+				b.WriteString(" " + line.Line1 + "\n")
+			case "delete":
+				b.WriteString("-" + line.Line1 + "\n")
+			case "insert":
+				b.WriteString("+" + line.Line2 + "\n")
+			}
+			if (line.Type != "insert" && left.isLast(line.LineNum1)) || (line.Type != "delete" && right.isLast(line.LineNum2)) {
+				b.WriteString(noNewlineMarker)
+			}
+		}
+	}
+}
+
+// patchFileName returns a download name for the patch of name.
+func patchFileName(name string) string {
+	return strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)) + ".diff"
+}
+
+// sendPatch writes a patch as a file download.
+func sendPatch(c *gin.Context, name, patch string) {
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Data(http.StatusOK, "text/x-diff; charset=utf-8", []byte(patch))
+}
+
+// HandleFileComparePatch downloads the text comparison of two files as a
+// unified diff that turns file1 into file2.
+func HandleFileComparePatch(c *gin.Context) {
+	file1, file2, ok := resolveFileComparePair(c)
+	if !ok {
+		return
+	}
+
+	opts, err := parseCompareOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contextLines, _, err := parseDiffContext(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	content1, err := readFileContent(file1.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file1: " + err.Error()})
+		return
+	}
+
+	content2, err := readFileContent(file2.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file2: " + err.Error()})
+		return
+	}
+
+	diffLines, _ := generateLineByLineDiff(strings.Split(content1, "\n"), strings.Split(content2, "\n"), opts)
+
+	var patch strings.Builder
+	writeUnifiedDiff(&patch, filepath.Base(file1.Name), content1, content2, diffLines, contextLines)
+	sendPatch(c, patchFileName(file1.Name), patch.String())
+}
+
+// HandleArchiveComparePatch downloads an archive comparison as a multi-file
+// patch turning every baby file into its candy counterpart.
+func HandleArchiveComparePatch(c *gin.Context) {
+	req, ok := parseArchiveCompareRequest(c)
+	if !ok {
+		return
+	}
+	sendArchivePatch(c, req)
+}
+
+// HandleArchiveJobPatch downloads the comparison of a completed archive job
+// as a multi-file patch. Job results keep no file contents, so the trades are
+// compared again with the job's parameters.
+func HandleArchiveJobPatch(c *gin.Context) {
+	job, ok := lookupArchiveJob(c)
+	if !ok {
+		return
+	}
+
+	status, _ := job.snapshot()
+	if status.State != archiveJobCompleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "job is " + status.State, "status": status})
+		return
+	}
+	sendArchivePatch(c, job.req)
+}
+
+// sendArchivePatch compares the trades of an archive, optionally limited by
+// the transaction_id and directory parameters, and sends them as a patch.
+func sendArchivePatch(c *gin.Context, req archiveCompareRequest) {
+	contextLines, _, err := parseDiffContext(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.selection = newComparisonSelection(contextLines, "baby_content", "candy_content", "diff_lines")
+
+	_, transactions, err := analyzeExtractedArchive(req.archive.Path, req.rule)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to analyze archive structure: " + err.Error()})
+		return
+	}
+	transactions = filterTransactions(transactions, c.Query("transaction_id"), c.Query("directory"))
+
+	comparisons, issues, err := compareTransactionFiles(c.Request.Context(), transactions, req, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to compare trade files: " + err.Error()})
+		return
+	}
+	// A patch silently missing a trade would be worse than none.
+	for _, issue := range issues {
+		if issue.Type == issueComparisonTimeout {
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": issue.Reason, "issues": issues})
+			return
+		}
+	}
+
+	var patch strings.Builder
+	for _, comparison := range comparisons {
+		path := filepath.ToSlash(filepath.Join(comparison.Directory, comparison.BabyFile))
+		writeUnifiedDiff(&patch, path, comparison.BabyContent, comparison.CandyContent, comparison.DiffLines, contextLines)
+	}
+	sendPatch(c, patchFileName(req.archive.Name), patch.String())
+}
+
+// filterTransactions keeps the trades with the given ID in the given
+// directory; empty values match everything.
+func filterTransactions(transactions []TransactionInfo, transactionID, dir string) []TransactionInfo {
+	var filtered []TransactionInfo
+	for _, transaction := range transactions {
+		if transactionID != "" && transaction.ID != transactionID {
+			continue
+		}
+		if dir != "" {
+			if !slices.Contains(transaction.Directories, dir) {
+				continue
+			}
+			transaction.Directories = []string{dir}
+		}
+		filtered = append(filtered, transaction)
+	}
+	return filtered
+}
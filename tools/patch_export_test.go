@@ -0,0 +1,234 @@
+package tools
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@$`)
+
+// splitPatchLines splits content into lines that keep their newline.
+func splitPatchLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// applyUnifiedDiff applies a multi-file unified diff like patch -p1, strictly
+// checking context and removed lines. files maps paths to their contents and
+// is updated in place.
+func applyUnifiedDiff(t *testing.T, files map[string]string, patch string) {
+	t.Helper()
+	lines := splitPatchLines(patch)
+
+	for i := 0; i < len(lines); {
+		if !strings.HasPrefix(lines[i], "--- a/") || i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ b/") {
+			t.Fatalf("patch line %d: expected a file header, got %q", i+1, lines[i])
+		}
+		path := strings.TrimSuffix(strings.TrimPrefix(lines[i], "--- a/"), "\n")
+		if target := strings.TrimSuffix(strings.TrimPrefix(lines[i+1], "+++ b/"), "\n"); target != path {
+			t.Fatalf("patch renames %s to %s", path, target)
+		}
+		original, ok := files[path]
+		if !ok {
+			t.Fatalf("patch for unknown file %s", path)
+		}
+		i += 2
+
+		src := splitPatchLines(original)
+		var result []string
+		cursor := 0
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+			m := hunkHeaderPattern.FindStringSubmatch(strings.TrimSuffix(lines[i], "\n"))
+			if m == nil {
+				t.Fatalf("patch line %d: malformed hunk header %q", i+1, lines[i])
+			}
+			oldStart, _ := strconv.Atoi(m[1])
+			oldCount, newCount := 1, 1
+			if m[2] != "" {
+				oldCount, _ = strconv.Atoi(m[2])
+			}
+			if m[4] != "" {
+				newCount, _ = strconv.Atoi(m[4])
+			}
+			i++
+
+			var old, new []string
+			for len(old) < oldCount || len(new) < newCount {
+				if i >= len(lines) {
+					t.Fatalf("%s: hunk ends early", path)
+				}
+				line := lines[i]
+				i++
+				if i < len(lines) && lines[i] == noNewlineMarker {
+					line = strings.TrimSuffix(line, "\n")
+					i++
+				}
+				switch line[0] {
+				case ' ':
+					old = append(old, line[1:])
+					new = append(new, line[1:])
+				case '-':
+					old = append(old, line[1:])
+				case '+':
+					new = append(new, line[1:])
+				default:
+					t.Fatalf("%s: unexpected hunk line %q", path, line)
+				}
+			}
+			if len(old) != oldCount || len(new) != newCount {
+				t.Fatalf("%s: hunk has %d old and %d new lines, header says %d and %d", path, len(old), len(new), oldCount, newCount)
+			}
+
+			// An empty old range starts after line oldStart.
+			start := oldStart - 1
+			if oldCount == 0 {
+				start = oldStart
+			}
+			if start < cursor || start+len(old) > len(src) {
+				t.Fatalf("%s: hunk %q is out of range", path, m[0])
+			}
+			for k, line := range old {
+				if src[start+k] != line {
+					t.Fatalf("%s: hunk %q expects line %d to be %q, got %q", path, m[0], start+k+1, line, src[start+k])
+				}
+			}
+			result = append(result, src[cursor:start]...)
+			result = append(result, new...)
+			cursor = start + len(old)
+		}
+		result = append(result, src[cursor:]...)
+		files[path] = strings.Join(result, "")
+	}
+}
+
+// numberedLines returns lines "line 1" to "line n", each with a newline.
+func numberedLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\n", i+1)
+	}
+	return lines
+}
+
+func TestWriteUnifiedDiffRoundTrip(t *testing.T) {
+	ignoreTimestamps := IgnoreRuleSet{Name: "timestamps", Rules: []IgnoreRule{{Name: "ts", Pattern: `^ts=`}}}
+	if err := ignoreTimestamps.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	long1 := numberedLines(40)
+	long2 := numberedLines(40)
+	long2[2] = "changed 3\n"
+	long2[20] = "changed 21\n"
+	long2 = append(long2[:35], long2[36:]...)
+
+	tests := []struct {
+		name     string
+		content1 string
+		content2 string
+		opts     CompareOptions
+		hunks    int // Hunks expected with 3 context lines.
+	}{
+		{"changed line", "a\nb\nc\n", "a\nB\nc\n", CompareOptions{}, 1},
+		{"no newline on the left", "a\nb\nc", "a\nb\nc\n", CompareOptions{}, 1},
+		{"no newline on the right", "a\nb\nc\n", "a\nb\nc", CompareOptions{}, 1},
+		{"no newline on either side", "a\nb\nc", "a\nb\nd", CompareOptions{}, 1},
+		{"no newline after an insertion", "a\nb", "a\nb\nc", CompareOptions{}, 1},
+		{"empty left file", "", "a\nb\n", CompareOptions{}, 1},
+		{"empty right file", "a\nb\n", "", CompareOptions{}, 1},
+		{"empty left file without newline", "", "a", CompareOptions{}, 1},
+		{"blank line against empty file", "\n", "", CompareOptions{}, 1},
+		{"ignored case", "id=1\nName=Foo\n", "id=1\nname=foo\n", CompareOptions{IgnoreCase: true}, 1},
+		{"ignored whitespace", "a\nb  c\nd\n", "a\nb c\nd\n", CompareOptions{IgnoreAllWhitespace: true}, 1},
+		{"ignored trailing whitespace", "a \nb\n", "a\nb\n", CompareOptions{IgnoreTrailingWhitespace: true}, 1},
+		{"ignored blank lines", "a\n\nb\n", "a\nb\n\n\n", CompareOptions{IgnoreBlankLines: true}, 1},
+		{"line endings", "a\r\nb\r\n", "a\nb\n", CompareOptions{NormalizeLineEndings: true}, 1},
+		{"ignore rule", "ts=10:00\npv=1\n", "ts=11:00\npv=2\n", CompareOptions{rules: ignoreTimestamps.Rules}, 1},
+		{"numeric tolerance", "pv=1.000\ndelta=2\n", "pv=1.001\ndelta=2\n", CompareOptions{NumericTolerance: true, AbsTolerance: 0.01}, 1},
+		{"several hunks", strings.Join(long1, ""), strings.Join(long2, ""), CompareOptions{}, 3},
+		{"patience", "x\na\nb\nx\n", "a\nx\nb\nx\n", CompareOptions{Algorithm: DiffAlgorithmPatience}, 1},
+	}
+
+	for _, tt := range tests {
+		for _, contextLines := range []int{0, 1, 3} {
+			t.Run(fmt.Sprintf("%s/context=%d", tt.name, contextLines), func(t *testing.T) {
+				diffLines, _ := generateLineByLineDiff(strings.Split(tt.content1, "\n"), strings.Split(tt.content2, "\n"), tt.opts)
+				var patch strings.Builder
+				writeUnifiedDiff(&patch, "risk.txt", tt.content1, tt.content2, diffLines, contextLines)
+
+				files := map[string]string{"risk.txt": tt.content1}
+				applyUnifiedDiff(t, files, patch.String())
+				if files["risk.txt"] != tt.content2 {
+					t.Errorf("patched file is %q, want %q\npatch:\n%s", files["risk.txt"], tt.content2, patch.String())
+				}
+				if got := strings.Count(patch.String(), "\n@@ "); contextLines == 3 && got != tt.hunks {
+					t.Errorf("got %d hunks, want %d\npatch:\n%s", got, tt.hunks, patch.String())
+				}
+			})
+		}
+	}
+}
+
+func TestWriteUnifiedDiffEqualContents(t *testing.T) {
+	diffLines, _ := generateLineByLineDiff([]string{"a", ""}, []string{"a", ""}, CompareOptions{})
+	var patch strings.Builder
+	writeUnifiedDiff(&patch, "risk.txt", "a\n", "a\n", diffLines, diffDefaultContext)
+	if patch.Len() != 0 {
+		t.Errorf("equal files produced a patch:\n%s", patch.String())
+	}
+}
+
+func TestHandleArchiveComparePatch(t *testing.T) {
+	root := filepath.Join(useTestUploads(t), "archive")
+
+	files := map[string]string{}
+	want := map[string]string{}
+	addTrade := func(dir, id, baby, candy string) {
+		writeTradeFiles(t, root, dir, id, baby, candy)
+		path := dir + "/babyy-risk-" + id + ".txt"
+		files[path], want[path] = baby, candy
+	}
+	addTrade("ABC", "1", "PV=100\nDelta=2\nGamma=3\n", "PV=101\nDelta=2\nGamma=3\n")
+	addTrade("ABC", "2", "PV=5\n", "PV=5\n")
+	addTrade("ABD", "1", "PV=7\nVega=1", "PV=7\nVega=1\nTheta=4\n")
+	addTrade("ABE", "3", "PV=1\n", "")
+
+	id, err := uploads.Register(uploadKindArchive, root, "release.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, contextLines := range []int{0, 3} {
+		w := serveTestRequest(HandleArchiveComparePatch, fmt.Sprintf("/api/archive-compare/patch?extract_dir=%s&workers=2&context=%d", id, contextLines))
+		if w.Code != http.StatusOK {
+			t.Fatalf("context=%d: status %d: %s", contextLines, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="release.diff"` {
+			t.Errorf("context=%d: Content-Disposition %q", contextLines, got)
+		}
+		patch := w.Body.String()
+		if n := strings.Count(patch, "--- a/"); n != 3 {
+			t.Errorf("context=%d: patch covers %d files, want 3:\n%s", contextLines, n, patch)
+		}
+
+		patched := map[string]string{}
+		for path, content := range files {
+			patched[path] = content
+		}
+		applyUnifiedDiff(t, patched, patch)
+		for path, content := range want {
+			if patched[path] != content {
+				t.Errorf("context=%d: patched %s is %q, want %q", contextLines, path, patched[path], content)
+			}
+		}
+	}
+
+}
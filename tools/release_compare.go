@@ -0,0 +1,324 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Release comparison matching modes.
+const (
+	releaseMatchPath        = "path"
+	releaseMatchTransaction = "transaction"
+)
+
+type ReleaseCompareResult struct {
+	BaselineName    string                  `json:"baseline_name"`
+	CandidateName   string                  `json:"candidate_name"`
+	Match           string                  `json:"match"` // "path" or "transaction"
+	OnlyInBaseline  []string                `json:"only_in_baseline"`
+	OnlyInCandidate []string                `json:"only_in_candidate"`
+	Identical       []string                `json:"identical"`
+	Different       []ReleaseFileComparison `json:"different"`
+	Issues          []ReleaseIssue          `json:"issues"`
+}
+
+type ReleaseFileComparison struct {
+	Key           string          `json:"key"`
+	BaselineFile  string          `json:"baseline_file"`
+	CandidateFile string          `json:"candidate_file"`
+	DiffLines     []DiffLine      `json:"diff_lines"`
+	Numeric       *NumericSummary `json:"numeric_summary,omitempty"`
+}
+
+// ReleaseIssue is a file of one release that could not be compared: an
+// extra file mapping to an already matched key, or a comparison that timed
+// out.
+type ReleaseIssue struct {
+	Release string `json:"release"` // "baseline" or "candidate"; empty for timeouts.
+	Key     string `json:"key"`
+	Type    string `json:"type"` // "duplicate_file" or "comparison_timeout"
+	File    string `json:"file,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// releaseFile is a file of one release keyed for matching.
+type releaseFile struct {
+	relPath string
+	path    string
+}
+
+func HandleReleaseUpload(c *gin.Context) {
+	// Create upload directory.
+	uploadDir := "uploads/archive-compare"
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create upload directory"})
+		return
+	}
+
+	timestamp := time.Now().UnixNano()
+	extractIDs := make(map[string]string)
+
+	for _, side := range []string{"baseline", "candidate"} {
+		// Retrieve uploaded file.
+		file, err := c.FormFile(side)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to retrieve " + side + " archive"})
+			return
+		}
+
+		filename := fmt.Sprintf("%d_%s_%s", timestamp, side, file.Filename)
+		filePath := filepath.Join(uploadDir, filename)
+		if err := c.SaveUploadedFile(file, filePath); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save file"})
+			return
+		}
+
+		// Extract archive.
+		extractDir := filepath.Join(uploadDir, fmt.Sprintf("extracted_%d_%s", timestamp, side))
+		if err := extractArchive(filePath, extractDir); err != nil {
+			status := http.StatusInternalServerError
+			if isArchiveClientError(err) {
+				status = http.StatusBadRequest
+			}
+			c.JSON(status, gin.H{"error": "failed to extract " + side + " archive: " + err.Error()})
+			return
+		}
+
+		id, err := uploads.Register(uploadKindArchive, extractDir, file.Filename)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register upload"})
+			return
+		}
+		extractIDs[side] = id
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "archives uploaded and extracted successfully",
+		"baseline_dir":  extractIDs["baseline"],
+		"candidate_dir": extractIDs["candidate"],
+	})
+}
+
+func HandleReleaseCompare(c *gin.Context) {
+	baselineID := c.Query("baseline")
+	candidateID := c.Query("candidate")
+
+	if baselineID == "" || candidateID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing baseline or candidate parameter"})
+		return
+	}
+
+	baseline, ok1 := uploads.Resolve(baselineID, uploadKindArchive)
+	candidate, ok2 := uploads.Resolve(candidateID, uploadKindArchive)
+	if !ok1 || !ok2 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "archive not found"})
+		return
+	}
+	baselineDir, candidateDir := baseline.Path, candidate.Path
+
+	opts, err := parseCompareOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	timeout, err := parseCompareTimeout(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	match := c.DefaultQuery("match", releaseMatchPath)
+	var baselineFiles, candidateFiles map[string]releaseFile
+	var baselineDuplicates, candidateDuplicates []ReleaseIssue
+	switch match {
+	case releaseMatchPath:
+		if baselineFiles, err = listReleaseFiles(baselineDir); err == nil {
+			candidateFiles, err = listReleaseFiles(candidateDir)
+		}
+	case releaseMatchTransaction:
+		rule, ruleErr := lookupPairingRule(c.Query("pairing_rule"))
+		if ruleErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": ruleErr.Error()})
+			return
+		}
+		if baselineFiles, baselineDuplicates, err = listReleaseTransactionFiles(baselineDir, rule, "baseline"); err == nil {
+			candidateFiles, candidateDuplicates, err = listReleaseTransactionFiles(candidateDir, rule, "candidate")
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported match mode: " + match})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to analyze archive structure: " + err.Error()})
+		return
+	}
+
+	result, err := compareReleases(c.Request.Context(), baselineFiles, candidateFiles, opts, timeout)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to compare archives: " + err.Error()})
+		return
+	}
+	result.BaselineName = baseline.Name
+	result.CandidateName = candidate.Name
+	result.Match = match
+	issues := append(baselineDuplicates, candidateDuplicates...)
+	result.Issues = append(issues, result.Issues...)
+	if result.Issues == nil {
+		result.Issues = []ReleaseIssue{}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// listReleaseFiles keys every regular file of an extracted archive by its
+// slash-separated path relative to the archive root.
+func listReleaseFiles(root string) (map[string]releaseFile, error) {
+	files := make(map[string]releaseFile)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		files[relPath] = releaseFile{relPath: relPath, path: path}
+		return nil
+	})
+
+	return files, err
+}
+
+// listReleaseTransactionFiles keys the trade files of an extracted archive by
+// directory, side and transaction ID so renamed files still match. Further
+// files with an already used key are reported as duplicates of release.
+func listReleaseTransactionFiles(root string, rule PairingRule, release string) (map[string]releaseFile, []ReleaseIssue, error) {
+	_, transactions, err := analyzeExtractedArchive(root, rule)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string]releaseFile)
+	duplicates := []ReleaseIssue{}
+	for _, transaction := range transactions {
+		for _, file := range transaction.Files {
+			key := strings.Join([]string{filepath.ToSlash(file.Directory), file.Type, transaction.ID}, "/")
+			relPath, err := filepath.Rel(root, file.FilePath)
+			if err != nil {
+				return nil, nil, err
+			}
+			relPath = filepath.ToSlash(relPath)
+			if chosen, ok := files[key]; ok {
+				duplicates = append(duplicates, ReleaseIssue{
+					Release: release,
+					Key:     key,
+					Type:    issueDuplicateFile,
+					File:    relPath,
+					Reason:  fmt.Sprintf("duplicate %s file for trade %s; %s is compared instead", file.Type, transaction.ID, chosen.relPath),
+				})
+				continue
+			}
+			files[key] = releaseFile{relPath: relPath, path: file.FilePath}
+		}
+	}
+
+	return files, duplicates, nil
+}
+
+// compareReleases diffs every key present in both releases and reports keys
+// that exist on one side only. A diff that exceeds timeout is reported as an
+// issue; the comparison stops with the context's error when ctx is cancelled.
+func compareReleases(ctx context.Context, baselineFiles, candidateFiles map[string]releaseFile, opts CompareOptions, timeout time.Duration) (ReleaseCompareResult, error) {
+	result := ReleaseCompareResult{
+		OnlyInBaseline:  []string{},
+		OnlyInCandidate: []string{},
+		Identical:       []string{},
+		Different:       []ReleaseFileComparison{},
+		Issues:          []ReleaseIssue{},
+	}
+
+	keys := make([]string, 0, len(baselineFiles))
+	for key := range baselineFiles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		baseline := baselineFiles[key]
+		candidate, ok := candidateFiles[key]
+		if !ok {
+			result.OnlyInBaseline = append(result.OnlyInBaseline, key)
+			continue
+		}
+
+		baselineContent, err := readFileContent(baseline.path)
+		if err != nil {
+			return result, err
+		}
+		candidateContent, err := readFileContent(candidate.path)
+		if err != nil {
+			return result, err
+		}
+
+		if baselineContent == candidateContent {
+			result.Identical = append(result.Identical, key)
+			continue
+		}
+
+		diffLines, numeric, err := diffReleaseFile(ctx, baselineContent, candidateContent, opts, timeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			result.Issues = append(result.Issues, ReleaseIssue{
+				Key:    key,
+				Type:   issueComparisonTimeout,
+				Reason: fmt.Sprintf("comparing %s took longer than %s", key, timeout),
+			})
+			continue
+		}
+		if !hasChanges(diffLines) {
+			result.Identical = append(result.Identical, key)
+			continue
+		}
+
+		result.Different = append(result.Different, ReleaseFileComparison{
+			Key:           key,
+			BaselineFile:  baseline.relPath,
+			CandidateFile: candidate.relPath,
+			DiffLines:     diffLines,
+			Numeric:       numeric,
+		})
+	}
+
+	for key := range candidateFiles {
+		if _, ok := baselineFiles[key]; !ok {
+			result.OnlyInCandidate = append(result.OnlyInCandidate, key)
+		}
+	}
+	sort.Strings(result.OnlyInCandidate)
+
+	return result, nil
+}
+
+// diffReleaseFile diffs the two versions of a file within timeout.
+func diffReleaseFile(ctx context.Context, baselineContent, candidateContent string, opts CompareOptions, timeout time.Duration) ([]DiffLine, *NumericSummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return generateLineByLineDiffContext(ctx, strings.Split(baselineContent, "\n"), strings.Split(candidateContent, "\n"), opts)
+}
@@ -0,0 +1,218 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeReleaseFiles writes files, keyed by slash-separated relative path,
+// under root.
+func writeReleaseFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// releaseKeys returns the keys of the different files of a result.
+func releaseKeys(different []ReleaseFileComparison) []string {
+	keys := []string{}
+	for _, comparison := range different {
+		keys = append(keys, comparison.Key)
+	}
+	return keys
+}
+
+func TestCompareReleasesByPath(t *testing.T) {
+	baseline, candidate := t.TempDir(), t.TempDir()
+	writeReleaseFiles(t, baseline, map[string]string{
+		"ABC/babyy-risk-1.txt": "PV=1\n",
+		"ABC/babyy-risk-2.txt": "PV=2\n",
+		"ABD/babyy-risk-1.txt": "PV=1\n",
+		"ABD/notes.txt":        "old\n",
+	})
+	writeReleaseFiles(t, candidate, map[string]string{
+		"ABC/babyy-risk-1.txt":  "PV=1\n",
+		"ABC/babyy-risk-2.txt":  "PV=2.5\n",
+		"ABD/babyy-risk-01.txt": "PV=1\n",
+		"ABE/babyy-risk-1.txt":  "PV=1\n",
+	})
+
+	baselineFiles, err := listReleaseFiles(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidateFiles, err := listReleaseFiles(candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := compareReleases(context.Background(), baselineFiles, candidateFiles, CompareOptions{}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"ABD/babyy-risk-1.txt", "ABD/notes.txt"}; !reflect.DeepEqual(result.OnlyInBaseline, want) {
+		t.Errorf("only in baseline = %v, want %v", result.OnlyInBaseline, want)
+	}
+	if want := []string{"ABD/babyy-risk-01.txt", "ABE/babyy-risk-1.txt"}; !reflect.DeepEqual(result.OnlyInCandidate, want) {
+		t.Errorf("only in candidate = %v, want %v", result.OnlyInCandidate, want)
+	}
+	if want := []string{"ABC/babyy-risk-1.txt"}; !reflect.DeepEqual(result.Identical, want) {
+		t.Errorf("identical = %v, want %v", result.Identical, want)
+	}
+	if want := []string{"ABC/babyy-risk-2.txt"}; !reflect.DeepEqual(releaseKeys(result.Different), want) {
+		t.Errorf("different = %v, want %v", releaseKeys(result.Different), want)
+	}
+	if len(result.Issues) != 0 {
+		t.Errorf("issues = %+v, want none", result.Issues)
+	}
+}
+
+func TestCompareReleasesByTransaction(t *testing.T) {
+	// Versioned file names map to the same trade, so a release holding two
+	// versions of a file has a duplicate.
+	rule := PairingRule{
+		Name:         "versioned",
+		LeftPattern:  `^babyy-risk-(?P<id>\d+)(?:-v\d+)?\.txt$`,
+		RightPattern: `^candyy-risk-(?P<id>\d+)(?:-v\d+)?\.txt$`,
+		LeftLabel:    "baby",
+		RightLabel:   "candy",
+	}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	baseline, candidate := t.TempDir(), t.TempDir()
+	writeReleaseFiles(t, baseline, map[string]string{
+		"ABC/babyy-risk-1.txt":  "PV=1\n",
+		"ABC/candyy-risk-1.txt": "PV=1\n",
+		"ABC/babyy-risk-2.txt":  "PV=2\n",
+		"ABD/babyy-risk-3.txt":  "PV=3\n",
+	})
+	writeReleaseFiles(t, candidate, map[string]string{
+		"ABC/babyy-risk-1-v2.txt": "PV=1\n",
+		"ABC/candyy-risk-1.txt":   "PV=1.5\n",
+		"ABC/babyy-risk-2.txt":    "PV=2\n",
+		"ABC/babyy-risk-2-v2.txt": "PV=20\n",
+		"ABE/babyy-risk-3.txt":    "PV=3\n",
+	})
+
+	baselineFiles, baselineDuplicates, err := listReleaseTransactionFiles(baseline, rule, "baseline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidateFiles, candidateDuplicates, err := listReleaseTransactionFiles(candidate, rule, "candidate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(baselineDuplicates) != 0 {
+		t.Errorf("baseline duplicates = %+v, want none", baselineDuplicates)
+	}
+	if len(candidateDuplicates) != 1 {
+		t.Fatalf("candidate duplicates = %+v, want one", candidateDuplicates)
+	}
+	duplicate := candidateDuplicates[0]
+	if duplicate.Release != "candidate" || duplicate.Key != "ABC/baby/2" || duplicate.Type != issueDuplicateFile {
+		t.Errorf("duplicate = %+v", duplicate)
+	}
+	// Files are walked in lexical order and the first one is kept.
+	if kept := candidateFiles["ABC/baby/2"].relPath; kept != "ABC/babyy-risk-2-v2.txt" || duplicate.File != "ABC/babyy-risk-2.txt" {
+		t.Errorf("kept %s and reported %s", kept, duplicate.File)
+	}
+
+	result, err := compareReleases(context.Background(), baselineFiles, candidateFiles, CompareOptions{}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ABD/baby/3"}; !reflect.DeepEqual(result.OnlyInBaseline, want) {
+		t.Errorf("only in baseline = %v, want %v", result.OnlyInBaseline, want)
+	}
+	if want := []string{"ABE/baby/3"}; !reflect.DeepEqual(result.OnlyInCandidate, want) {
+		t.Errorf("only in candidate = %v, want %v", result.OnlyInCandidate, want)
+	}
+	if want := []string{"ABC/baby/1"}; !reflect.DeepEqual(result.Identical, want) {
+		t.Errorf("identical = %v, want %v", result.Identical, want)
+	}
+	if want := []string{"ABC/baby/2", "ABC/candy/1"}; !reflect.DeepEqual(releaseKeys(result.Different), want) {
+		t.Fatalf("different = %v, want %v", releaseKeys(result.Different), want)
+	}
+	if different := result.Different[0]; different.BaselineFile != "ABC/babyy-risk-2.txt" || different.CandidateFile != "ABC/babyy-risk-2-v2.txt" {
+		t.Errorf("different files %s and %s", different.BaselineFile, different.CandidateFile)
+	}
+}
+
+func TestCompareReleasesTimeout(t *testing.T) {
+	baseline, candidate := t.TempDir(), t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	writeReleaseFiles(t, baseline, map[string]string{"slow.txt": pathologicalLines(rng, 20000), "fast.txt": "a\n"})
+	writeReleaseFiles(t, candidate, map[string]string{"slow.txt": pathologicalLines(rng, 20000), "fast.txt": "b\n"})
+	baselineFiles, _ := listReleaseFiles(baseline)
+	candidateFiles, _ := listReleaseFiles(candidate)
+
+	result, err := compareReleases(context.Background(), baselineFiles, candidateFiles, CompareOptions{}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Issues) != 1 || result.Issues[0].Key != "slow.txt" || result.Issues[0].Type != issueComparisonTimeout {
+		t.Errorf("issues = %+v, want a timeout of slow.txt", result.Issues)
+	}
+	if want := []string{"fast.txt"}; !reflect.DeepEqual(releaseKeys(result.Different), want) {
+		t.Errorf("different = %v, want %v", releaseKeys(result.Different), want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := compareReleases(ctx, baselineFiles, candidateFiles, CompareOptions{}, time.Minute); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestHandleReleaseCompare(t *testing.T) {
+	root := useTestUploads(t)
+	baseline, candidate := filepath.Join(root, "baseline"), filepath.Join(root, "candidate")
+	writeReleaseFiles(t, baseline, map[string]string{"ABC/babyy-risk-1.txt": "PV=1\n"})
+	writeReleaseFiles(t, candidate, map[string]string{"ABC/babyy-risk-1.txt": "PV=2\n"})
+	baselineID, err := uploads.Register(uploadKindArchive, baseline, "r1.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidateID, err := uploads.Register(uploadKindArchive, candidate, "r2.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "/api/archive-compare/releases/compare?baseline=" + baselineID + "&candidate=" + candidateID
+
+	for _, match := range []string{releaseMatchPath, releaseMatchTransaction} {
+		w := serveTestRequest(HandleReleaseCompare, query+"&match="+match)
+		if w.Code != http.StatusOK {
+			t.Fatalf("match=%s: status %d: %s", match, w.Code, w.Body.String())
+		}
+		var result ReleaseCompareResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Match != match || len(result.Different) != 1 || result.Issues == nil {
+			t.Errorf("match=%s: result %+v", match, result)
+		}
+	}
+
+	for _, params := range []string{"&match=name", "&timeout=-1s"} {
+		if w := serveTestRequest(HandleReleaseCompare, query+params); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", params, w.Code)
+		}
+	}
+}
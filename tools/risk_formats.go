@@ -0,0 +1,390 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const riskFormatsFile = "config/risk_formats.json"
+
+// Risk file parsers.
+const (
+	riskParserKeyValue   = "key_value"
+	riskParserFixedWidth = "fixed_width"
+	riskParserDelimited  = "delimited"
+)
+
+// Risk measure statuses.
+const (
+	riskMeasureEqual     = "equal"
+	riskMeasureDifferent = "different"
+	riskMeasureLeftOnly  = "left_only"
+	riskMeasureRightOnly = "right_only"
+)
+
+// RiskFormat describes how to read the measures of a risk file. Parser
+// selects the layout; the remaining fields configure it.
+type RiskFormat struct {
+	Name          string `json:"name"`
+	Parser        string `json:"parser"`                   // "key_value", "fixed_width" or "delimited"
+	CommentPrefix string `json:"comment_prefix,omitempty"` // Lines starting with it are skipped (default "#").
+
+	// key_value: "PV = 1234.5" lines split at the first Separator (default "=").
+	Separator string `json:"separator,omitempty"`
+
+	// fixed_width: character spans of the measure name and value.
+	NameSpan  *RiskSpan `json:"name_span,omitempty"`
+	ValueSpan *RiskSpan `json:"value_span,omitempty"`
+
+	// delimited: rows split by Delimiter (default ","), grouped into sections
+	// by lines matching SectionPattern (default "[Name]"). Measures are named
+	// "section.name" from NameColumn (default 0) and valued from ValueColumn
+	// (default 1).
+	Delimiter      string `json:"delimiter,omitempty"`
+	SectionPattern string `json:"section_pattern,omitempty"`
+	NameColumn     int    `json:"name_column,omitempty"`
+	ValueColumn    int    `json:"value_column,omitempty"`
+	SkipHeader     bool   `json:"skip_header,omitempty"` // Skip the first row of each section.
+
+	parser riskParser
+}
+
+// RiskSpan is a zero-based character range; End 0 means the end of the line.
+type RiskSpan struct {
+	Start int `json:"start"`
+	End   int `json:"end,omitempty"`
+}
+
+// RiskMeasure compares one measure of a trade between the two sides.
+type RiskMeasure struct {
+	Name       string   `json:"name"`
+	BabyValue  string   `json:"baby_value"`
+	CandyValue string   `json:"candy_value"`
+	AbsDiff    *float64 `json:"abs_diff,omitempty"` // Set when both values are numeric.
+	RelDiff    *float64 `json:"rel_diff,omitempty"`
+	Status     string   `json:"status"` // "equal", "different", "left_only" or "right_only"
+}
+
+// riskValue is a raw measure read from a risk file.
+type riskValue struct {
+	name  string
+	value string
+}
+
+// riskParser extracts named measures from the lines of a risk file.
+type riskParser interface {
+	parse(lines []string) []riskValue
+}
+
+// riskParsers builds the parser for each supported layout.
+var riskParsers = map[string]func(*RiskFormat) (riskParser, error){
+	riskParserKeyValue:   newKeyValueParser,
+	riskParserFixedWidth: newFixedWidthParser,
+	riskParserDelimited:  newDelimitedParser,
+}
+
+var riskFormats = &configStore[RiskFormat]{
+	path:    riskFormatsFile,
+	name:    func(f RiskFormat) string { return f.Name },
+	compile: (*RiskFormat).compile,
+}
+
+// compile validates the format and builds its parser.
+func (f *RiskFormat) compile() error {
+	if f.Name == "" {
+		return errors.New("risk format name is required")
+	}
+	if f.CommentPrefix == "" {
+		f.CommentPrefix = "#"
+	}
+
+	build, ok := riskParsers[f.Parser]
+	if !ok {
+		return fmt.Errorf("risk format %q: unsupported parser %q", f.Name, f.Parser)
+	}
+	parser, err := build(f)
+	if err != nil {
+		return fmt.Errorf("risk format %q: %v", f.Name, err)
+	}
+	f.parser = parser
+	return nil
+}
+
+// lookupRiskFormat returns the named risk format, or nil when name is empty.
+func lookupRiskFormat(name string) (*RiskFormat, error) {
+	if name == "" {
+		return nil, nil
+	}
+	format, ok, err := riskFormats.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown risk format %q", name)
+	}
+	return &format, nil
+}
+
+// dataLines returns the lines that are neither blank nor comments.
+func (f *RiskFormat) dataLines(lines []string) []string {
+	var data []string
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, f.CommentPrefix) {
+			continue
+		}
+		data = append(data, line)
+	}
+	return data
+}
+
+// keyValueParser reads "name = value" lines.
+type keyValueParser struct {
+	format    *RiskFormat
+	separator string
+}
+
+func newKeyValueParser(f *RiskFormat) (riskParser, error) {
+	if f.Separator == "" {
+		f.Separator = "="
+	}
+	return keyValueParser{format: f, separator: f.Separator}, nil
+}
+
+func (p keyValueParser) parse(lines []string) []riskValue {
+	var values []riskValue
+	for _, line := range p.format.dataLines(lines) {
+		name, value, ok := strings.Cut(line, p.separator)
+		if !ok {
+			continue
+		}
+		values = append(values, riskValue{name: strings.TrimSpace(name), value: strings.TrimSpace(value)})
+	}
+	return values
+}
+
+// fixedWidthParser reads the name and value from fixed character spans.
+type fixedWidthParser struct {
+	format      *RiskFormat
+	name, value RiskSpan
+}
+
+func newFixedWidthParser(f *RiskFormat) (riskParser, error) {
+	if f.NameSpan == nil || f.ValueSpan == nil {
+		return nil, errors.New("fixed_width requires name_span and value_span")
+	}
+	for _, span := range []*RiskSpan{f.NameSpan, f.ValueSpan} {
+		if span.Start < 0 || span.End != 0 && span.End <= span.Start {
+			return nil, fmt.Errorf("invalid span %d-%d", span.Start, span.End)
+		}
+	}
+	return fixedWidthParser{format: f, name: *f.NameSpan, value: *f.ValueSpan}, nil
+}
+
+func (p fixedWidthParser) parse(lines []string) []riskValue {
+	var values []riskValue
+	for _, line := range p.format.dataLines(lines) {
+		name := strings.TrimSpace(p.name.cut(line))
+		if name == "" {
+			continue
+		}
+		values = append(values, riskValue{name: name, value: strings.TrimSpace(p.value.cut(line))})
+	}
+	return values
+}
+
+// cut returns the part of the line covered by the span, counted in runes.
+func (s RiskSpan) cut(line string) string {
+	runes := []rune(line)
+	if s.Start >= len(runes) {
+		return ""
+	}
+	end := s.End
+	if end == 0 || end > len(runes) {
+		end = len(runes)
+	}
+	return string(runes[s.Start:end])
+}
+
+// delimitedParser reads delimited rows grouped into named sections.
+type delimitedParser struct {
+	format  *RiskFormat
+	section *regexp.Regexp
+}
+
+func newDelimitedParser(f *RiskFormat) (riskParser, error) {
+	if f.Delimiter == "" {
+		f.Delimiter = ","
+	}
+	if f.SectionPattern == "" {
+		f.SectionPattern = `^\[(.+)\]$`
+	}
+	if f.NameColumn == 0 && f.ValueColumn == 0 {
+		f.ValueColumn = 1
+	}
+	if f.NameColumn < 0 || f.ValueColumn < 0 || f.NameColumn == f.ValueColumn {
+		return nil, errors.New("name_column and value_column must be distinct, non-negative columns")
+	}
+
+	section, err := regexp.Compile(f.SectionPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid section pattern: %v", err)
+	}
+	if section.NumSubexp() == 0 {
+		return nil, errors.New("section pattern must capture the section name")
+	}
+	return delimitedParser{format: f, section: section}, nil
+}
+
+func (p delimitedParser) parse(lines []string) []riskValue {
+	var values []riskValue
+	section := ""
+	header := false
+
+	for _, line := range p.format.dataLines(lines) {
+		if m := p.section.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			section = strings.TrimSpace(m[1])
+			header = p.format.SkipHeader
+			continue
+		}
+		if header {
+			header = false
+			continue
+		}
+
+		fields := strings.Split(line, p.format.Delimiter)
+		if p.format.NameColumn >= len(fields) || p.format.ValueColumn >= len(fields) {
+			continue
+		}
+		name := strings.TrimSpace(fields[p.format.NameColumn])
+		if section != "" {
+			name = section + "." + name
+		}
+		values = append(values, riskValue{name: name, value: strings.TrimSpace(fields[p.format.ValueColumn])})
+	}
+	return values
+}
+
+// compareRiskMeasures parses both sides with the format and pairs measures
+// by name. Numeric values are equal when within either tolerance; repeated
+// names are numbered so every occurrence is compared.
+func compareRiskMeasures(format *RiskFormat, lines1, lines2 []string, opts CompareOptions) []RiskMeasure {
+	values1 := numberRiskValues(format.parser.parse(lines1))
+	values2 := numberRiskValues(format.parser.parse(lines2))
+
+	right := make(map[string]string, len(values2))
+	for _, value := range values2 {
+		right[value.name] = value.value
+	}
+
+	measures := []RiskMeasure{}
+	seen := make(map[string]bool, len(values1))
+	for _, value := range values1 {
+		seen[value.name] = true
+		candy, ok := right[value.name]
+		if !ok {
+			measures = append(measures, RiskMeasure{Name: value.name, BabyValue: value.value, Status: riskMeasureLeftOnly})
+			continue
+		}
+		measures = append(measures, compareRiskValues(value.name, value.value, candy, opts))
+	}
+	for _, value := range values2 {
+		if !seen[value.name] {
+			measures = append(measures, RiskMeasure{Name: value.name, CandyValue: value.value, Status: riskMeasureRightOnly})
+		}
+	}
+
+	return measures
+}
+
+// numberRiskValues renames repeated measure names to "name#2", "name#3", ...
+func numberRiskValues(values []riskValue) []riskValue {
+	counts := make(map[string]int, len(values))
+	for i, value := range values {
+		counts[value.name]++
+		if n := counts[value.name]; n > 1 {
+			values[i].name = fmt.Sprintf("%s#%d", value.name, n)
+		}
+	}
+	return values
+}
+
+// compareRiskValues compares two values of a measure within the tolerances.
+// Values that are not finite numbers, such as NaN or Inf, compare as text.
+func compareRiskValues(name, baby, candy string, opts CompareOptions) RiskMeasure {
+	measure := RiskMeasure{Name: name, BabyValue: baby, CandyValue: candy, Status: riskMeasureDifferent}
+
+	x, okX := parseFiniteFloat(baby)
+	y, okY := parseFiniteFloat(candy)
+	if !okX || !okY {
+		if baby == candy {
+			measure.Status = riskMeasureEqual
+		}
+		return measure
+	}
+
+	absDiff := math.Abs(x - y)
+	relDiff := 0.0
+	if scale := math.Max(math.Abs(x), math.Abs(y)); scale > 0 {
+		relDiff = absDiff / scale
+	}
+	measure.AbsDiff, measure.RelDiff = &absDiff, &relDiff
+
+	if absDiff <= opts.AbsTolerance || relDiff <= opts.RelTolerance {
+		measure.Status = riskMeasureEqual
+	}
+	return measure
+}
+
+func HandleRiskFormatsList(c *gin.Context) {
+	formats, err := riskFormats.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load risk formats: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"risk_formats": formats})
+}
+
+func HandleRiskFormatsSave(c *gin.Context) {
+	var format RiskFormat
+	if err := c.ShouldBindJSON(&format); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid risk format: " + err.Error()})
+		return
+	}
+	if err := format.compile(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := riskFormats.Put(format); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save risk formats: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "risk format saved successfully",
+		"risk_format": format,
+	})
+}
+
+func HandleRiskFormatsDelete(c *gin.Context) {
+	deleted, err := riskFormats.Delete(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save risk formats: " + err.Error()})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "risk format not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "risk format deleted successfully"})
+}
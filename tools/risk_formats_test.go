@@ -0,0 +1,37 @@
+package tools
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCompareRiskValues(t *testing.T) {
+	opts := CompareOptions{AbsTolerance: 0.01}
+	tests := []struct {
+		baby, candy string
+		status      string
+		numeric     bool
+	}{
+		{"1.000", "1.005", riskMeasureEqual, true},
+		{"1", "2", riskMeasureDifferent, true},
+		{"n/a", "n/a", riskMeasureEqual, false},
+		{"NaN", "1", riskMeasureDifferent, false},
+		{"1", "NaN", riskMeasureDifferent, false},
+		{"NaN", "NaN", riskMeasureEqual, false},
+		{"Inf", "1", riskMeasureDifferent, false},
+		{"Inf", "-Inf", riskMeasureDifferent, false},
+		{"+Inf", "+Inf", riskMeasureEqual, false},
+	}
+	for _, tt := range tests {
+		measure := compareRiskValues("PV", tt.baby, tt.candy, opts)
+		if measure.Status != tt.status {
+			t.Errorf("%s vs %s: status %q, want %q", tt.baby, tt.candy, measure.Status, tt.status)
+		}
+		if (measure.AbsDiff != nil) != tt.numeric || (measure.RelDiff != nil) != tt.numeric {
+			t.Errorf("%s vs %s: numeric differences set = %v, want %v", tt.baby, tt.candy, measure.AbsDiff != nil, tt.numeric)
+		}
+		if _, err := json.Marshal(measure); err != nil {
+			t.Errorf("%s vs %s: measure cannot be encoded: %v", tt.baby, tt.candy, err)
+		}
+	}
+}
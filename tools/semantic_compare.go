@@ -0,0 +1,562 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// File compare modes.
+const (
+	fileCompareModeText     = "text"
+	fileCompareModeSemantic = "semantic"
+)
+
+// Structured document formats.
+const (
+	documentFormatAuto = "auto"
+	documentFormatJSON = "json"
+	documentFormatYAML = "yaml"
+	documentFormatXML  = "xml"
+)
+
+// Semantic change types.
+const (
+	semanticAdded    = "added"
+	semanticRemoved  = "removed"
+	semanticModified = "modified"
+)
+
+// SemanticChange is a difference between two parsed documents at a path
+// such as $.trades[3].notional.
+type SemanticChange struct {
+	Path  string      `json:"path"`
+	Type  string      `json:"type"` // "added", "removed" or "modified"
+	Left  interface{} `json:"left,omitempty"`
+	Right interface{} `json:"right,omitempty"`
+}
+
+// SemanticOptions controls a semantic comparison.
+type SemanticOptions struct {
+	Format           string   `json:"format"`
+	IgnoreArrayOrder bool     `json:"ignore_array_order"`
+	IgnorePaths      []string `json:"ignore_paths,omitempty"`
+
+	ignore []*regexp.Regexp
+	// Numeric tolerances shared with the text comparison options.
+	numeric  bool
+	abs, rel float64
+}
+
+// identifierPattern matches object keys that can be written in dot notation.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseSemanticOptions reads the semantic comparison options from the query
+// string.
+func parseSemanticOptions(c *gin.Context, opts CompareOptions) (SemanticOptions, error) {
+	semantic := SemanticOptions{
+		Format:  c.DefaultQuery("format", documentFormatAuto),
+		numeric: opts.NumericTolerance,
+		abs:     opts.AbsTolerance,
+		rel:     opts.RelTolerance,
+	}
+
+	switch semantic.Format {
+	case documentFormatAuto, documentFormatJSON, documentFormatYAML, documentFormatXML:
+	default:
+		return semantic, fmt.Errorf("unsupported format %q", semantic.Format)
+	}
+
+	if raw := c.Query("ignore_array_order"); raw != "" {
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return semantic, fmt.Errorf("invalid value for ignore_array_order: %q", raw)
+		}
+		semantic.IgnoreArrayOrder = value
+	}
+
+	for _, path := range c.QueryArray("ignore_path") {
+		re, err := compileIgnorePath(path)
+		if err != nil {
+			return semantic, err
+		}
+		semantic.IgnorePaths = append(semantic.IgnorePaths, path)
+		semantic.ignore = append(semantic.ignore, re)
+	}
+
+	return semantic, nil
+}
+
+// compileIgnorePath turns a path pattern into a regular expression. "*"
+// matches any key and "[*]" any index; a pattern also covers everything
+// below the path it names.
+func compileIgnorePath(path string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(path, "$") {
+		path = "$." + path
+	}
+	pattern := regexp.QuoteMeta(path)
+	pattern = strings.ReplaceAll(pattern, `\[\*\]`, `\[\d+\]`)
+	pattern = strings.ReplaceAll(pattern, `\*`, `[^.\[\]]+`)
+	re, err := regexp.Compile(`^` + pattern + `(?:[.\[].*)?$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ignore_path %q: %v", path, err)
+	}
+	return re, nil
+}
+
+// detectDocumentFormat picks a format from the file extension, falling back
+// to the first non-blank character of the content.
+func detectDocumentFormat(name, content string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return documentFormatJSON
+	case ".yaml", ".yml":
+		return documentFormatYAML
+	case ".xml":
+		return documentFormatXML
+	}
+
+	trimmed := strings.TrimLeft(content, " \t\r\n\ufeff")
+	switch {
+	case strings.HasPrefix(trimmed, "{"), strings.HasPrefix(trimmed, "["):
+		return documentFormatJSON
+	case strings.HasPrefix(trimmed, "<"):
+		return documentFormatXML
+	}
+	return documentFormatYAML
+}
+
+// parseDocument parses a JSON, YAML or XML document into maps, slices and
+// scalars. Numbers are represented as json.Number.
+func parseDocument(content, format string) (interface{}, error) {
+	content = strings.TrimPrefix(content, "\ufeff")
+
+	switch format {
+	case documentFormatJSON:
+		decoder := json.NewDecoder(strings.NewReader(content))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, fmt.Errorf("unexpected data after the document")
+		}
+		return value, nil
+	case documentFormatYAML:
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(content), &value); err != nil {
+			return nil, err
+		}
+		return normalizeYAML(value), nil
+	case documentFormatXML:
+		return parseXMLDocument(content)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+// normalizeYAML converts decoded YAML into the representation used for JSON.
+// NaN and infinities become the strings "NaN", "+Inf" and "-Inf".
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeYAML(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+		return v
+	case int:
+		return json.Number(strconv.Itoa(v))
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	case float64:
+		// .nan and .inf have no JSON number form; keep them as text.
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+// xmlNode is an element while the document is being parsed.
+type xmlNode struct {
+	name     string
+	attrs    map[string]interface{}
+	children map[string][]interface{}
+	order    []string
+	text     strings.Builder
+}
+
+// parseXMLDocument converts XML into nested maps. Attributes become "@name"
+// keys, repeated child elements become arrays and text content is stored
+// under "#text", or as the element value for elements holding only text.
+func parseXMLDocument(content string) (interface{}, error) {
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	var stack []*xmlNode
+	var root interface{}
+	rootName := ""
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, attrs: make(map[string]interface{}), children: make(map[string][]interface{})}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				node.attrs["@"+attr.Name.Local] = attr.Value
+			}
+			stack = append(stack, node)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			value := node.value()
+			if len(stack) == 0 {
+				root, rootName = value, node.name
+				continue
+			}
+			parent := stack[len(stack)-1]
+			if _, ok := parent.children[node.name]; !ok {
+				parent.order = append(parent.order, node.name)
+			}
+			parent.children[node.name] = append(parent.children[node.name], value)
+		}
+	}
+
+	if rootName == "" {
+		return nil, fmt.Errorf("no root element")
+	}
+	return map[string]interface{}{rootName: root}, nil
+}
+
+func (n *xmlNode) value() interface{} {
+	text := strings.TrimSpace(n.text.String())
+	if len(n.attrs) == 0 && len(n.children) == 0 {
+		return text
+	}
+
+	m := n.attrs
+	for _, name := range n.order {
+		if children := n.children[name]; len(children) == 1 {
+			m[name] = children[0]
+		} else {
+			m[name] = children
+		}
+	}
+	if text != "" {
+		m["#text"] = text
+	}
+	return m
+}
+
+// compareDocuments parses two documents and returns their differences.
+func compareDocuments(name1, content1, name2, content2 string, opts SemanticOptions) ([]SemanticChange, [2]string, error) {
+	var formats [2]string
+	var values [2]interface{}
+	names := [2]string{name1, name2}
+	contents := [2]string{content1, content2}
+
+	for i := range contents {
+		formats[i] = opts.Format
+		if formats[i] == documentFormatAuto {
+			formats[i] = detectDocumentFormat(names[i], contents[i])
+		}
+		value, err := parseDocument(contents[i], formats[i])
+		if err != nil {
+			return nil, formats, fmt.Errorf("file%d is not valid %s: %v", i+1, strings.ToUpper(formats[i]), err)
+		}
+		values[i] = value
+	}
+
+	changes := []SemanticChange{}
+	diffDocumentValues("$", values[0], values[1], opts, &changes)
+	return changes, formats, nil
+}
+
+// diffDocumentValues appends the differences between two values at a path.
+func diffDocumentValues(path string, a, b interface{}, opts SemanticOptions, changes *[]SemanticChange) {
+	if isIgnoredPath(path, opts) {
+		return
+	}
+
+	switch x := a.(type) {
+	case map[string]interface{}:
+		if y, ok := b.(map[string]interface{}); ok {
+			diffDocumentObjects(path, x, y, opts, changes)
+			return
+		}
+	case []interface{}:
+		if y, ok := b.([]interface{}); ok {
+			if opts.IgnoreArrayOrder {
+				diffUnorderedArrays(path, x, y, opts, changes)
+			} else {
+				diffOrderedArrays(path, x, y, opts, changes)
+			}
+			return
+		}
+	default:
+		if scalarsEqual(a, b, opts) {
+			return
+		}
+	}
+
+	*changes = append(*changes, SemanticChange{Path: path, Type: semanticModified, Left: a, Right: b})
+}
+
+func diffDocumentObjects(path string, a, b map[string]interface{}, opts SemanticOptions, changes *[]SemanticChange) {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		childPath := objectPath(path, key)
+		x, inA := a[key]
+		y, inB := b[key]
+		switch {
+		case !inB:
+			addSemanticChange(childPath, semanticRemoved, x, nil, opts, changes)
+		case !inA:
+			addSemanticChange(childPath, semanticAdded, nil, y, opts, changes)
+		default:
+			diffDocumentValues(childPath, x, y, opts, changes)
+		}
+	}
+}
+
+// diffOrderedArrays aligns two arrays with the line diff engine so an
+// insertion does not shift every later element into a change. Changed
+// elements in the same block are paired and compared recursively.
+func diffOrderedArrays(path string, a, b []interface{}, opts SemanticOptions, changes *[]SemanticChange) {
+	changed1, changed2 := diffKeys(canonicalKeys(path, a, opts), canonicalKeys(path, b, opts), DiffAlgorithmMyers)
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && !changed1[i] && !changed2[j] {
+			i++
+			j++
+			continue
+		}
+
+		var deletes, inserts []int
+		for ; i < len(a) && changed1[i]; i++ {
+			deletes = append(deletes, i)
+		}
+		for ; j < len(b) && changed2[j]; j++ {
+			inserts = append(inserts, j)
+		}
+		diffArrayBlock(path, a, b, deletes, inserts, opts, changes)
+	}
+}
+
+// diffUnorderedArrays matches equal elements regardless of position and
+// pairs the remaining elements in order.
+func diffUnorderedArrays(path string, a, b []interface{}, opts SemanticOptions, changes *[]SemanticChange) {
+	keysA, keysB := canonicalKeys(path, a, opts), canonicalKeys(path, b, opts)
+	unmatched := make(map[string][]int)
+	for j, key := range keysB {
+		unmatched[key] = append(unmatched[key], j)
+	}
+
+	var deletes []int
+	matched := make([]bool, len(b))
+	for i, key := range keysA {
+		if candidates := unmatched[key]; len(candidates) > 0 {
+			matched[candidates[0]] = true
+			unmatched[key] = candidates[1:]
+			continue
+		}
+		deletes = append(deletes, i)
+	}
+
+	var inserts []int
+	for j := range b {
+		if !matched[j] {
+			inserts = append(inserts, j)
+		}
+	}
+	diffArrayBlock(path, a, b, deletes, inserts, opts, changes)
+}
+
+// diffArrayBlock pairs removed and inserted elements by position, reporting
+// paired elements under the left index and the rest as removed or added.
+func diffArrayBlock(path string, a, b []interface{}, deletes, inserts []int, opts SemanticOptions, changes *[]SemanticChange) {
+	pairs := len(deletes)
+	if len(inserts) < pairs {
+		pairs = len(inserts)
+	}
+	for k := 0; k < pairs; k++ {
+		diffDocumentValues(indexPath(path, deletes[k]), a[deletes[k]], b[inserts[k]], opts, changes)
+	}
+	for _, i := range deletes[pairs:] {
+		addSemanticChange(indexPath(path, i), semanticRemoved, a[i], nil, opts, changes)
+	}
+	for _, j := range inserts[pairs:] {
+		addSemanticChange(indexPath(path, j), semanticAdded, nil, b[j], opts, changes)
+	}
+}
+
+func addSemanticChange(path, changeType string, left, right interface{}, opts SemanticOptions, changes *[]SemanticChange) {
+	if isIgnoredPath(path, opts) {
+		return
+	}
+	*changes = append(*changes, SemanticChange{Path: path, Type: changeType, Left: left, Right: right})
+}
+
+func isIgnoredPath(path string, opts SemanticOptions) bool {
+	for _, re := range opts.ignore {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// scalarsEqual compares two scalar values. Numbers compare by value, within
+// the numeric tolerances when numeric mode is enabled. Numeric mode also
+// compares numeric strings by value, which covers XML text.
+func scalarsEqual(a, b interface{}, opts SemanticOptions) bool {
+	x, okA := a.(json.Number)
+	y, okB := b.(json.Number)
+	if opts.numeric {
+		if s, ok := a.(string); ok && isNumericString(s) {
+			x, okA = json.Number(s), true
+		}
+		if s, ok := b.(string); ok && isNumericString(s) {
+			y, okB = json.Number(s), true
+		}
+	}
+	if !okA || !okB {
+		return a == b
+	}
+	if x == y {
+		return true
+	}
+
+	valueA, errA := x.Float64()
+	valueB, errB := y.Float64()
+	if errA != nil || errB != nil {
+		return false
+	}
+	if valueA == valueB {
+		return true
+	}
+	if !opts.numeric {
+		return false
+	}
+
+	absDiff := math.Abs(valueA - valueB)
+	relDiff := absDiff / math.Max(math.Abs(valueA), math.Abs(valueB))
+	return absDiff <= opts.abs || relDiff <= opts.rel
+}
+
+// isNumericString reports whether s is a finite number; "NaN" and "Inf"
+// compare as text.
+func isNumericString(s string) bool {
+	_, ok := parseFiniteFloat(s)
+	return ok
+}
+
+// canonicalKeys serialises the elements of the array at path with sorted
+// object keys, normalised numbers and ignored paths left out, so elements
+// that compare equal get equal keys.
+func canonicalKeys(path string, values []interface{}, opts SemanticOptions) []string {
+	keys := make([]string, len(values))
+	for i, value := range values {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(canonicalValue(indexPath(path, i), value, opts)); err != nil {
+			keys[i] = fmt.Sprint(value)
+			continue
+		}
+		keys[i] = buf.String()
+	}
+	return keys
+}
+
+// canonicalValue rewrites numbers in their shortest form, so 200.0 and 200
+// serialise the same way, and drops ignored paths.
+func canonicalValue(path string, value interface{}, opts SemanticOptions) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			childPath := objectPath(path, key)
+			if !isIgnoredPath(childPath, opts) {
+				m[key] = canonicalValue(childPath, item, opts)
+			}
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for i, item := range v {
+			childPath := indexPath(path, i)
+			if !isIgnoredPath(childPath, opts) {
+				items = append(items, canonicalValue(childPath, item, opts))
+			}
+		}
+		return items
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	}
+	return value
+}
+
+func objectPath(path, key string) string {
+	if identifierPattern.MatchString(key) {
+		return path + "." + key
+	}
+	return path + "[" + strconv.Quote(key) + "]"
+}
+
+func indexPath(path string, index int) string {
+	return fmt.Sprintf("%s[%d]", path, index)
+}
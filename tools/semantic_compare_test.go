@@ -0,0 +1,226 @@
+package tools
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testSemanticOptions returns options ignoring the given path patterns.
+func testSemanticOptions(t *testing.T, ignorePaths ...string) SemanticOptions {
+	t.Helper()
+	opts := SemanticOptions{Format: documentFormatAuto}
+	for _, path := range ignorePaths {
+		re, err := compileIgnorePath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.IgnorePaths = append(opts.IgnorePaths, path)
+		opts.ignore = append(opts.ignore, re)
+	}
+	return opts
+}
+
+// changePaths returns the type and path of every change.
+func changePaths(changes []SemanticChange) []string {
+	paths := []string{}
+	for _, change := range changes {
+		paths = append(paths, change.Type+" "+change.Path)
+	}
+	return paths
+}
+
+func TestCompareDocuments(t *testing.T) {
+	tolerance := testSemanticOptions(t)
+	tolerance.numeric, tolerance.abs = true, 0.01
+	unordered := testSemanticOptions(t)
+	unordered.IgnoreArrayOrder = true
+
+	tests := []struct {
+		name         string
+		file1, file2 string
+		content1     string
+		content2     string
+		opts         SemanticOptions
+		want         []string
+	}{
+		{
+			name:     "reordered keys",
+			file1:    "a.json",
+			file2:    "b.json",
+			content1: `{"id": 1, "trade": {"ccy": "USD", "notional": 200.0}}`,
+			content2: `{"trade": {"notional": 200, "ccy": "USD"}, "id": 1}`,
+			opts:     testSemanticOptions(t),
+			want:     []string{},
+		},
+		{
+			name:     "json and yaml",
+			file1:    "a.json",
+			file2:    "b.yaml",
+			content1: `{"id": 1, "tags": ["a", "b"]}`,
+			content2: "tags: [a, c]\nid: 2\n",
+			opts:     testSemanticOptions(t),
+			want:     []string{"modified $.id", "modified $.tags[1]"},
+		},
+		{
+			name:     "ignored key wildcard",
+			file1:    "a.json",
+			file2:    "b.json",
+			content1: `{"meta": {"host": "a", "run": 1}, "pv": 1}`,
+			content2: `{"meta": {"host": "b", "run": 2, "user": "x"}, "pv": 2}`,
+			opts:     testSemanticOptions(t, "meta.*"),
+			want:     []string{"modified $.pv"},
+		},
+		{
+			name:     "ignored index wildcard",
+			file1:    "a.json",
+			file2:    "b.json",
+			content1: `{"trades": [{"id": 1, "ts": "10:00"}, {"id": 2, "ts": "10:01"}]}`,
+			content2: `{"trades": [{"id": 1, "ts": "11:00"}, {"id": 3, "ts": "11:01"}]}`,
+			opts:     testSemanticOptions(t, "$.trades[*].ts"),
+			want:     []string{"modified $.trades[1].id"},
+		},
+		{
+			name:     "array order",
+			file1:    "a.json",
+			file2:    "b.json",
+			content1: `{"legs": [{"id": 1}, {"id": 2}, {"id": 3}]}`,
+			content2: `{"legs": [{"id": 3}, {"id": 1}, {"id": 2}]}`,
+			opts:     testSemanticOptions(t),
+			want:     []string{"added $.legs[0]", "removed $.legs[2]"},
+		},
+		{
+			name:     "ignore array order",
+			file1:    "a.json",
+			file2:    "b.json",
+			content1: `{"legs": [{"id": 1}, {"id": 2}, {"id": 3}]}`,
+			content2: `{"legs": [{"id": 3}, {"id": 1}, {"id": 4}]}`,
+			opts:     unordered,
+			want:     []string{"modified $.legs[1].id"},
+		},
+		{
+			name:     "inserted element",
+			file1:    "a.json",
+			file2:    "b.json",
+			content1: `[1, 2, 3]`,
+			content2: `[1, 5, 2, 3]`,
+			opts:     testSemanticOptions(t),
+			want:     []string{"added $[1]"},
+		},
+		{
+			name:     "xml attributes and repeated elements",
+			file1:    "a.xml",
+			file2:    "b.xml",
+			content1: `<trade id="1"><leg ccy="USD">100</leg><leg ccy="EUR">200</leg></trade>`,
+			content2: `<trade id="2"><leg ccy="USD">100</leg><leg ccy="GBP">200</leg><leg ccy="JPY">300</leg></trade>`,
+			opts:     testSemanticOptions(t),
+			want:     []string{`modified $.trade["@id"]`, `modified $.trade.leg[1]["@ccy"]`, "added $.trade.leg[2]"},
+		},
+		{
+			name:     "numeric tolerance",
+			file1:    "a.json",
+			file2:    "b.json",
+			content1: `{"pv": 100.000, "delta": 1.5, "label": "1.0"}`,
+			content2: `{"pv": 100.005, "delta": 1.6, "label": "1.001"}`,
+			opts:     tolerance,
+			want:     []string{"modified $.delta"},
+		},
+		{
+			name:     "numeric strings without tolerance",
+			file1:    "a.xml",
+			file2:    "b.xml",
+			content1: `<risk><pv>100.000</pv></risk>`,
+			content2: `<risk><pv>100.005</pv></risk>`,
+			opts:     testSemanticOptions(t),
+			want:     []string{"modified $.risk.pv"},
+		},
+		{
+			name:     "numeric strings with tolerance",
+			file1:    "a.xml",
+			file2:    "b.xml",
+			content1: `<risk><pv>100.000</pv></risk>`,
+			content2: `<risk><pv>100.005</pv></risk>`,
+			opts:     tolerance,
+			want:     []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, _, err := compareDocuments(tt.file1, tt.content1, tt.file2, tt.content2, tt.opts)
+			if err != nil {
+				t.Fatalf("compareDocuments: %v", err)
+			}
+			if got := changePaths(changes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseXMLDocument(t *testing.T) {
+	value, err := parseDocument(`<trade id="7" xmlns="urn:x"><leg>1</leg><leg>2</leg><book>FX</book>note</trade>`, documentFormatXML)
+	if err != nil {
+		t.Fatalf("parseDocument: %v", err)
+	}
+	want := map[string]interface{}{
+		"trade": map[string]interface{}{
+			"@id":   "7",
+			"leg":   []interface{}{"1", "2"},
+			"book":  "FX",
+			"#text": "note",
+		},
+	}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("parseDocument = %#v, want %#v", value, want)
+	}
+}
+
+func TestCompareDocumentsNonFiniteYAML(t *testing.T) {
+	content1 := "pv: .nan\nvega: .inf\ntheta: -.inf\ngamma: 1\n"
+	content2 := "pv: .nan\nvega: 1\ntheta: -.inf\ngamma: .NaN\n"
+
+	for _, numeric := range []bool{false, true} {
+		opts := testSemanticOptions(t)
+		opts.numeric, opts.abs, opts.rel = numeric, 1e9, 1
+
+		changes, _, err := compareDocuments("a.yaml", content1, "b.yaml", content2, opts)
+		if err != nil {
+			t.Fatalf("compareDocuments: %v", err)
+		}
+		want := []string{"modified $.gamma", "modified $.vega"}
+		if got := changePaths(changes); !reflect.DeepEqual(got, want) {
+			t.Errorf("numeric=%v: changes = %q, want %q", numeric, got, want)
+		}
+		if _, err := json.Marshal(changes); err != nil {
+			t.Errorf("numeric=%v: changes cannot be encoded: %v", numeric, err)
+		}
+	}
+}
+
+func TestCompileIgnorePath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"meta", "$.meta", true},
+		{"meta", "$.meta.host", true},
+		{"meta", "$.metadata", false},
+		{"$.trades[*].ts", "$.trades[12].ts", true},
+		{"$.trades[*].ts", "$.trades[x].ts", false},
+		{"$.trades[*].ts", "$.trades[0].tsx", false},
+		{"*.ts", "$.legs.ts", true},
+		{"*.ts", "$.legs[0].ts", false},
+		{"$[*]", "$[3].id", true},
+	}
+	for _, tt := range tests {
+		re, err := compileIgnorePath(tt.pattern)
+		if err != nil {
+			t.Fatalf("compileIgnorePath(%q): %v", tt.pattern, err)
+		}
+		if got := re.MatchString(tt.path); got != tt.want {
+			t.Errorf("%q matches %q = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
@@ -2,9 +2,17 @@ package tools
 
 // DiffLine represents a single diff result line.
 type DiffLine struct {
-	Type     string `json:"type"` // "equal", "delete", "insert"
-	Line1    string `json:"line1"`
-	Line2    string `json:"line2"`
-	LineNum1 int    `json:"line_num1"`
-	LineNum2 int    `json:"line_num2"`
+	Type      string        `json:"type"` // "equal", "delete", "insert", "modify"
+	Line1     string        `json:"line1"`
+	Line2     string        `json:"line2"`
+	LineNum1  int           `json:"line_num1"`
+	LineNum2  int           `json:"line_num2"`
+	Segments1 []DiffSegment `json:"segments1,omitempty"` // Set for "modify" lines.
+	Segments2 []DiffSegment `json:"segments2,omitempty"` // Set for "modify" lines.
+}
+
+// DiffSegment is a span of text within one side of a modified line.
+type DiffSegment struct {
+	Type string `json:"type"` // "equal", "delete" (left side), "insert" (right side)
+	Text string `json:"text"`
 }
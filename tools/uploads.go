@@ -0,0 +1,163 @@
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload kinds. A handle only resolves for the kind it was registered with.
+const (
+	uploadKindFileCompare = "file-compare"
+	uploadKindCSV         = "csv"
+	uploadKindArchive     = "archive" // An extracted archive directory.
+)
+
+const (
+	uploadRoot         = "uploads"
+	uploadRegistryFile = "uploads/registry.json"
+)
+
+// uploadEntry maps an opaque upload ID to a server-managed path.
+type uploadEntry struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Path      string    `json:"path"`
+	Name      string    `json:"name"` // Original file name shown to users.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// uploadRegistry hands out upload IDs so API clients never pass filesystem
+// paths. Entries are persisted so handles survive a restart.
+type uploadRegistry struct {
+	mu      sync.Mutex
+	root    string
+	path    string
+	loaded  bool
+	entries map[string]uploadEntry
+}
+
+var uploads = &uploadRegistry{root: uploadRoot, path: uploadRegistryFile}
+
+// load reads the persisted entries on first use. Callers hold r.mu.
+func (r *uploadRegistry) load() error {
+	if r.loaded {
+		return nil
+	}
+	r.entries = make(map[string]uploadEntry)
+
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		r.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []uploadEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", r.path, err)
+	}
+	for _, entry := range entries {
+		r.entries[entry.ID] = entry
+	}
+	r.loaded = true
+	return nil
+}
+
+// save writes all entries to disk. Callers hold r.mu.
+func (r *uploadRegistry) save() error {
+	entries := make([]uploadEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0644)
+}
+
+// prune drops entries whose files or directories no longer exist, so the
+// registry does not grow with uploads that were cleaned up. Callers hold r.mu.
+func (r *uploadRegistry) prune() {
+	for id, entry := range r.entries {
+		if _, err := os.Stat(entry.Path); errors.Is(err, os.ErrNotExist) {
+			delete(r.entries, id)
+		}
+	}
+}
+
+// contains reports whether path lies inside the upload root.
+func (r *uploadRegistry) contains(path string) bool {
+	root, err := filepath.Abs(r.root)
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Register records a path under the upload root and returns its ID. Entries
+// of deleted uploads are pruned when the registry is saved.
+func (r *uploadRegistry) Register(kind, path, name string) (string, error) {
+	if !r.contains(path) {
+		return "", fmt.Errorf("refusing to register %s outside %s", path, r.root)
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return "", err
+	}
+	r.entries[id] = uploadEntry{
+		ID:        id,
+		Kind:      kind,
+		Path:      path,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+	r.prune()
+	if err := r.save(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Resolve returns the entry for an upload ID of the given kind. Unknown IDs,
+// kind mismatches and paths outside the upload root all resolve to false.
+func (r *uploadRegistry) Resolve(id, kind string) (uploadEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return uploadEntry{}, false
+	}
+	entry, ok := r.entries[id]
+	if !ok || entry.Kind != kind || !r.contains(entry.Path) {
+		return uploadEntry{}, false
+	}
+	return entry, true
+}
@@ -0,0 +1,170 @@
+package tools
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// useTestUploads points the upload registry at a temporary root for the
+// duration of the test and returns that root.
+func useTestUploads(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	saved := uploads
+	uploads = &uploadRegistry{root: root, path: filepath.Join(root, "registry.json")}
+	t.Cleanup(func() { uploads = saved })
+	return root
+}
+
+// registerTestUpload writes content to a file under the test upload root
+// and registers it.
+func registerTestUpload(t *testing.T, kind, name, content string) string {
+	t.Helper()
+	path := filepath.Join(uploads.root, kind+"_"+name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, err := uploads.Register(kind, path, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// serveTestRequest runs handler for a GET request of target.
+func serveTestRequest(handler gin.HandlerFunc, target string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	handler(c)
+	return w
+}
+
+func TestUploadRegistryResolve(t *testing.T) {
+	root := useTestUploads(t)
+	id := registerTestUpload(t, uploadKindFileCompare, "trade.txt", "PV=1\n")
+
+	entry, ok := uploads.Resolve(id, uploadKindFileCompare)
+	if !ok || entry.Name != "trade.txt" || entry.Path != filepath.Join(root, "file-compare_trade.txt") {
+		t.Fatalf("Resolve = %+v, %v", entry, ok)
+	}
+	if _, ok := uploads.Resolve("0123456789abcdef0123456789abcdef", uploadKindFileCompare); ok {
+		t.Error("unknown ID resolved")
+	}
+	if _, ok := uploads.Resolve("", uploadKindFileCompare); ok {
+		t.Error("empty ID resolved")
+	}
+	if _, ok := uploads.Resolve(id, uploadKindCSV); ok {
+		t.Error("ID resolved for the wrong kind")
+	}
+
+	// A restarted server resolves the persisted ID.
+	restarted := &uploadRegistry{root: root, path: uploads.path}
+	if _, ok := restarted.Resolve(id, uploadKindFileCompare); !ok {
+		t.Error("ID not resolved after a restart")
+	}
+}
+
+func TestUploadRegistryRejectsPathsOutsideRoot(t *testing.T) {
+	root := useTestUploads(t)
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{outside, root, filepath.Join(root, "..", "secret.txt")} {
+		if _, err := uploads.Register(uploadKindFileCompare, path, "secret.txt"); err == nil {
+			t.Errorf("registered %s", path)
+		}
+	}
+
+	// Entries edited into the registry file must not resolve either.
+	entries := []uploadEntry{
+		{ID: "outside", Kind: uploadKindFileCompare, Path: outside},
+		{ID: "root", Kind: uploadKindFileCompare, Path: root},
+		{ID: "dotdot", Kind: uploadKindFileCompare, Path: filepath.Join(root, "..", filepath.Base(outside))},
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(uploads.path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tampered := &uploadRegistry{root: root, path: uploads.path}
+	for _, entry := range entries {
+		if _, ok := tampered.Resolve(entry.ID, uploadKindFileCompare); ok {
+			t.Errorf("entry %s with path %s resolved", entry.ID, entry.Path)
+		}
+	}
+	uploads = tampered
+
+	w := serveTestRequest(HandleFileCompare, "/api/file-compare/compare?file1=outside&file2=outside")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("compare with an entry outside the upload root: status %d, want 404", w.Code)
+	}
+}
+
+func TestUploadHandlersRejectUnknownIDs(t *testing.T) {
+	useTestUploads(t)
+	text := registerTestUpload(t, uploadKindFileCompare, "trade.txt", "PV=1\n")
+	csv := registerTestUpload(t, uploadKindCSV, "trades.csv", "id,pv\n1,2\n")
+
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+		target  string
+	}{
+		{"unknown file", HandleFileCompare, "/api/file-compare/compare?file1=" + text + "&file2=unknown"},
+		{"csv as text file", HandleFileCompare, "/api/file-compare/compare?file1=" + text + "&file2=" + csv},
+		{"path as file", HandleFileCompare, "/api/file-compare/compare?file1=" + text + "&file2=" + url.QueryEscape("../go.mod")},
+		{"text file as csv", HandleCSVView, "/api/csv/view?file=" + text},
+		{"text file as archive", HandleArchiveCompare, "/api/archive-compare/compare?extract_dir=" + text},
+		{"csv as archive", HandleArchiveCompare, "/api/archive-compare/compare?extract_dir=" + csv},
+	}
+	for _, tt := range tests {
+		if w := serveTestRequest(tt.handler, tt.target); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404: %s", tt.name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestUploadRegistryPrunesDeletedUploads(t *testing.T) {
+	useTestUploads(t)
+	kept := registerTestUpload(t, uploadKindFileCompare, "kept.txt", "a\n")
+	deleted := registerTestUpload(t, uploadKindFileCompare, "deleted.txt", "b\n")
+	entry, _ := uploads.Resolve(deleted, uploadKindFileCompare)
+	if err := os.Remove(entry.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	registerTestUpload(t, uploadKindFileCompare, "new.txt", "c\n")
+
+	data, err := os.ReadFile(uploads.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []uploadEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("registry has %d entries, want 2", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.ID == deleted {
+			t.Error("entry of the deleted upload was kept")
+		}
+	}
+	if _, ok := uploads.Resolve(kept, uploadKindFileCompare); !ok {
+		t.Error("existing upload was pruned")
+	}
+}
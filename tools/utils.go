@@ -1,8 +1,12 @@
 package tools
 
 import (
+	"context"
 	"io"
 	"os"
+	"time"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
 // readFileContent reads the entire file content into a string.
@@ -21,117 +25,195 @@ func readFileContent(filepath string) (string, error) {
 	return string(content), nil
 }
 
-// generateLineByLineDiff builds a line-by-line diff result.
-func generateLineByLineDiff(lines1, lines2 []string) []DiffLine {
-	var diffLines []DiffLine
+// generateLineByLineDiff builds a line-by-line diff result. Lines are
+// matched on their normalized form; changed blocks list deletes before inserts.
+// The numeric summary is nil unless numeric tolerance mode is enabled.
+func generateLineByLineDiff(lines1, lines2 []string, opts CompareOptions) ([]DiffLine, *NumericSummary) {
+	diffLines, numeric, _ := generateLineByLineDiffContext(context.Background(), lines1, lines2, opts)
+	return diffLines, numeric
+}
+
+// generateLineByLineDiffContext is generateLineByLineDiff giving up with
+// ctx's error once ctx is done.
+func generateLineByLineDiffContext(ctx context.Context, lines1, lines2 []string, opts CompareOptions) ([]DiffLine, *NumericSummary, error) {
+	changed1, changed2, err := diffKeysContext(ctx, opts.lineKeys(lines1), opts.lineKeys(lines2), opts.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var numeric *NumericSummary
+	if opts.NumericTolerance {
+		numeric = &NumericSummary{
+			AbsTolerance: opts.AbsTolerance,
+			RelTolerance: opts.RelTolerance,
+		}
+	}
 
-	// Use a simple LCS-inspired comparison.
+	diffLines := make([]DiffLine, 0, len(lines1)+len(lines2))
 	i, j := 0, 0
-	lineNum1, lineNum2 := 1, 1
 
 	for i < len(lines1) || j < len(lines2) {
-		if i >= len(lines1) {
-			// File1 is exhausted, remaining lines are inserts.
+		if i < len(lines1) && changed1[i] {
+			lineType := "delete"
+			if opts.isIgnoredLine(lines1[i]) {
+				// Ignored lines show up unpaired but unchanged.
+				lineType = "equal"
+			}
 			diffLines = append(diffLines, DiffLine{
-				Type:     "insert",
+				Type:     lineType,
+				Line1:    lines1[i],
+				Line2:    "",
+				LineNum1: i + 1,
+				LineNum2: 0,
+			})
+			i++
+		} else if j < len(lines2) && changed2[j] {
+			lineType := "insert"
+			if opts.isIgnoredLine(lines2[j]) {
+				lineType = "equal"
+			}
+			diffLines = append(diffLines, DiffLine{
+				Type:     lineType,
 				Line1:    "",
 				Line2:    lines2[j],
 				LineNum1: 0,
-				LineNum2: lineNum2,
+				LineNum2: j + 1,
 			})
 			j++
-			lineNum2++
-		} else if j >= len(lines2) {
-			// File2 is exhausted, remaining lines are deletes.
+		} else if numeric != nil && !numeric.compareNumbers(opts.normalizeLine(lines1[i]), opts.normalizeLine(lines2[j]), i+1) {
+			// Aligned line with a material numeric break.
+			segments1, segments2 := lineSegments(ctx, lines1[i], lines2[j])
 			diffLines = append(diffLines, DiffLine{
-				Type:     "delete",
-				Line1:    lines1[i],
-				Line2:    "",
-				LineNum1: lineNum1,
-				LineNum2: 0,
+				Type:      "modify",
+				Line1:     lines1[i],
+				Line2:     lines2[j],
+				LineNum1:  i + 1,
+				LineNum2:  j + 1,
+				Segments1: segments1,
+				Segments2: segments2,
 			})
 			i++
-			lineNum1++
-		} else if lines1[i] == lines2[j] {
-			// Lines are identical.
+			j++
+		} else {
+			// Both sides are on a common line.
 			diffLines = append(diffLines, DiffLine{
 				Type:     "equal",
 				Line1:    lines1[i],
 				Line2:    lines2[j],
-				LineNum1: lineNum1,
-				LineNum2: lineNum2,
+				LineNum1: i + 1,
+				LineNum2: j + 1,
 			})
 			i++
 			j++
-			lineNum1++
-			lineNum2++
-		} else {
-			// Lines differ, apply heuristics.
-			// Simple heuristic: if the next line matches, treat current line as a modification.
-			if i+1 < len(lines1) && j+1 < len(lines2) && lines1[i+1] == lines2[j+1] {
-				diffLines = append(diffLines, DiffLine{
-					Type:     "delete",
-					Line1:    lines1[i],
-					Line2:    "",
-					LineNum1: lineNum1,
-					LineNum2: 0,
-				})
-				diffLines = append(diffLines, DiffLine{
-					Type:     "insert",
-					Line1:    "",
-					Line2:    lines2[j],
-					LineNum1: 0,
-					LineNum2: lineNum2,
-				})
-				i++
-				j++
-				lineNum1++
-				lineNum2++
-			} else if i+1 < len(lines1) && lines1[i+1] == lines2[j] {
-				// File1 has an extra line.
-				diffLines = append(diffLines, DiffLine{
-					Type:     "delete",
-					Line1:    lines1[i],
-					Line2:    "",
-					LineNum1: lineNum1,
-					LineNum2: 0,
-				})
-				i++
-				lineNum1++
-			} else if j+1 < len(lines2) && lines1[i] == lines2[j+1] {
-				// File2 has an extra line.
-				diffLines = append(diffLines, DiffLine{
-					Type:     "insert",
-					Line1:    "",
-					Line2:    lines2[j],
-					LineNum1: 0,
-					LineNum2: lineNum2,
-				})
-				j++
-				lineNum2++
+		}
+	}
+
+	diffLines = pairModifiedLines(ctx, diffLines)
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return diffLines, numeric, nil
+}
+
+// pairModifiedLines turns each delete/insert pair within a changed block into
+// a single "modify" line with intra-line segments. Unpaired lines are kept.
+func pairModifiedLines(ctx context.Context, diffLines []DiffLine) []DiffLine {
+	result := make([]DiffLine, 0, len(diffLines))
+
+	for start := 0; start < len(diffLines); {
+		if diffLines[start].Type != "delete" && diffLines[start].Type != "insert" {
+			result = append(result, diffLines[start])
+			start++
+			continue
+		}
+
+		// Collect the changed block.
+		var deletes, inserts []DiffLine
+		end := start
+		for end < len(diffLines) && (diffLines[end].Type == "delete" || diffLines[end].Type == "insert") {
+			if diffLines[end].Type == "delete" {
+				deletes = append(deletes, diffLines[end])
 			} else {
-				// Nothing matches, treat as a modification.
-				diffLines = append(diffLines, DiffLine{
-					Type:     "delete",
-					Line1:    lines1[i],
-					Line2:    "",
-					LineNum1: lineNum1,
-					LineNum2: 0,
-				})
-				diffLines = append(diffLines, DiffLine{
-					Type:     "insert",
-					Line1:    "",
-					Line2:    lines2[j],
-					LineNum1: 0,
-					LineNum2: lineNum2,
-				})
-				i++
-				j++
-				lineNum1++
-				lineNum2++
+				inserts = append(inserts, diffLines[end])
 			}
+			end++
+		}
+
+		pairs := len(deletes)
+		if len(inserts) < pairs {
+			pairs = len(inserts)
+		}
+		for k := 0; k < pairs; k++ {
+			segments1, segments2 := lineSegments(ctx, deletes[k].Line1, inserts[k].Line2)
+			result = append(result, DiffLine{
+				Type:      "modify",
+				Line1:     deletes[k].Line1,
+				Line2:     inserts[k].Line2,
+				LineNum1:  deletes[k].LineNum1,
+				LineNum2:  inserts[k].LineNum2,
+				Segments1: segments1,
+				Segments2: segments2,
+			})
+		}
+		result = append(result, deletes[pairs:]...)
+		result = append(result, inserts[pairs:]...)
+
+		start = end
+	}
+
+	return result
+}
+
+// newDiffMatchPatch returns a character differ that settles for a coarser
+// diff rather than run past ctx's deadline.
+func newDiffMatchPatch(ctx context.Context) *diffmatchpatch.DiffMatchPatch {
+	dmp := diffmatchpatch.New()
+	if deadline, ok := ctx.Deadline(); ok {
+		// A zero timeout would mean no limit at all.
+		dmp.DiffTimeout = max(min(dmp.DiffTimeout, time.Until(deadline)), time.Nanosecond)
+	}
+	return dmp
+}
+
+// lineSegments computes the character-level spans of a modified line pair.
+func lineSegments(ctx context.Context, line1, line2 string) ([]DiffSegment, []DiffSegment) {
+	dmp := newDiffMatchPatch(ctx)
+	diffs := dmp.DiffMain(line1, line2, false)
+	diffs = dmp.DiffCleanupSemantic(diffs)
+
+	var segments1, segments2 []DiffSegment
+	for _, d := range diffs {
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			segments1 = append(segments1, DiffSegment{Type: "equal", Text: d.Text})
+			segments2 = append(segments2, DiffSegment{Type: "equal", Text: d.Text})
+		case diffmatchpatch.DiffDelete:
+			segments1 = append(segments1, DiffSegment{Type: "delete", Text: d.Text})
+		case diffmatchpatch.DiffInsert:
+			segments2 = append(segments2, DiffSegment{Type: "insert", Text: d.Text})
 		}
 	}
 
-	return diffLines
+	return segments1, segments2
+}
+
+// hasChanges reports whether a diff contains any non-equal line.
+func hasChanges(diffLines []DiffLine) bool {
+	for _, line := range diffLines {
+		if line.Type != "equal" {
+			return true
+		}
+	}
+	return false
+}
+
+// countChangedLines returns the number of diff lines that are not equal.
+func countChangedLines(diffLines []DiffLine) int {
+	count := 0
+	for _, line := range diffLines {
+		if line.Type != "equal" {
+			count++
+		}
+	}
+	return count
 }